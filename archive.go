@@ -0,0 +1,486 @@
+package certgrep
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Archive formats, see Archive.
+const (
+	ArchiveTarZstd = "tar.zst"
+	ArchiveZip     = "zip"
+)
+
+func isArchiveFormat(format string) bool {
+	return format == ArchiveTarZstd || format == ArchiveZip
+}
+
+// archiveEntry is a file, directory (os.ModeDir) or symlink (os.ModeSymlink)
+// in an archive. Names are slash separated.
+type archiveEntry struct {
+	name    string
+	mode    os.FileMode
+	size    int64
+	modTime time.Time
+	// symlink target
+	link string
+}
+
+type archiveWriter interface {
+	add(entry archiveEntry, r io.Reader) error
+	close() error
+}
+
+type tarArchive struct {
+	zst *zstd.Encoder
+	tw  *tar.Writer
+}
+
+func newTarArchive(w io.Writer) (*tarArchive, error) {
+	zst, err := zstd.NewWriter(w)
+	if err != nil {
+		return nil, err
+	}
+	return &tarArchive{zst: zst, tw: tar.NewWriter(zst)}, nil
+}
+
+func (a *tarArchive) add(entry archiveEntry, r io.Reader) error {
+	hdr := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     entry.name,
+		Mode:     int64(entry.mode.Perm()),
+		Size:     entry.size,
+		ModTime:  entry.modTime,
+		Format:   tar.FormatPAX,
+	}
+	switch {
+	case entry.mode.IsDir():
+		hdr.Typeflag = tar.TypeDir
+		hdr.Name += "/"
+	case entry.mode&os.ModeSymlink != 0:
+		hdr.Typeflag = tar.TypeSymlink
+		hdr.Linkname = entry.link
+		hdr.Size = 0
+	}
+	if err := a.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if hdr.Typeflag != tar.TypeReg {
+		return nil
+	}
+	_, err := io.Copy(a.tw, r)
+	return err
+}
+
+func (a *tarArchive) close() error {
+	err := a.tw.Close()
+	if cerr := a.zst.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+type zipArchive struct {
+	zw *zip.Writer
+}
+
+func (a *zipArchive) add(entry archiveEntry, r io.Reader) error {
+	hdr := &zip.FileHeader{
+		Name:     entry.name,
+		Method:   zip.Deflate,
+		Modified: entry.modTime,
+	}
+	hdr.SetMode(entry.mode)
+	switch {
+	case entry.mode.IsDir():
+		hdr.Name += "/"
+		hdr.Method = zip.Store
+		r = nil
+	case entry.mode&os.ModeSymlink != 0:
+		// like Info-ZIP, the target is the content
+		hdr.Method = zip.Store
+		r = strings.NewReader(entry.link)
+	}
+	w, err := a.zw.CreateHeader(hdr)
+	if err != nil || r == nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	return err
+}
+
+func (a *zipArchive) close() error {
+	return a.zw.Close()
+}
+
+// archiveFS writes the output directory to a single archive, so that a long
+// capture doesn't leave hundreds of thousands of small files behind. Entries
+// are named relative to the parent of the output directory. Files written
+// over the whole run (logs, the SQLite database) are spooled to disk and
+// added when the archive is closed.
+//
+// The archive is written to a temporary file and renamed into place once
+// complete. A failed write leaves the archive stream in an unknown state, so
+// every later write fails with the same error.
+type archiveFS struct {
+	path    string
+	base    string
+	durable bool
+	f       *os.File
+	w       archiveWriter
+	// entries added so far
+	names   map[string]bool
+	spool   string
+	spooled []string
+	err     error
+}
+
+func newArchiveFS(format, path, base string, durable bool) (*archiveFS, error) {
+	dir, name := filepath.Split(path)
+	if err := os.MkdirAll(dir, defaultDirPerm); err != nil {
+		return nil, err
+	}
+	f, err := ioutil.TempFile(dir, "."+name+".tmp")
+	if err != nil {
+		return nil, err
+	}
+	spool, err := ioutil.TempDir(dir, "."+name+".spool")
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+
+	a := &archiveFS{
+		path:    path,
+		base:    base,
+		durable: durable,
+		f:       f,
+		names:   make(map[string]bool),
+		spool:   spool,
+	}
+	switch format {
+	case ArchiveTarZstd:
+		a.w, err = newTarArchive(f)
+	case ArchiveZip:
+		a.w = &zipArchive{zw: zip.NewWriter(f)}
+	default:
+		err = fmt.Errorf("invalid archive format")
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		os.RemoveAll(spool)
+		return nil, err
+	}
+	return a, nil
+}
+
+// entryName returns the name of the entry for path.
+func (a *archiveFS) entryName(path string) (string, error) {
+	if !within(a.base, path) {
+		return "", fmt.Errorf("%s is outside of the archive", path)
+	}
+	rel, err := filepath.Rel(a.base, path)
+	return filepath.ToSlash(rel), err
+}
+
+func (a *archiveFS) add(entry archiveEntry, r io.Reader) error {
+	if a.err != nil {
+		return a.err
+	}
+	if a.names[entry.name] {
+		return fmt.Errorf("%s is already in the archive", entry.name)
+	}
+	if entry.modTime.IsZero() {
+		entry.modTime = time.Now()
+	}
+	if a.err = a.w.add(entry, r); a.err != nil {
+		return a.err
+	}
+	a.names[entry.name] = true
+	return nil
+}
+
+func (a *archiveFS) mkdirAll(dir string) error {
+	name, err := a.entryName(dir)
+	if err != nil || name == "." || a.names[name] {
+		return err
+	}
+	if err = a.mkdirAll(filepath.Dir(dir)); err != nil {
+		return err
+	}
+	return a.add(archiveEntry{name: name, mode: os.ModeDir | defaultDirPerm}, nil)
+}
+
+func (a *archiveFS) writeFile(path string, data []byte, perm os.FileMode) error {
+	name, err := a.entryName(path)
+	if err != nil {
+		return err
+	}
+	return a.add(archiveEntry{name: name, mode: perm, size: int64(len(data))}, bytes.NewReader(data))
+}
+
+func (a *archiveFS) symlink(target, path string) error {
+	name, err := a.entryName(path)
+	if err != nil {
+		return err
+	}
+	if a.names[name] {
+		return &os.LinkError{Op: "symlink", Old: target, New: path, Err: os.ErrExist}
+	}
+	return a.add(archiveEntry{name: name, mode: os.ModeSymlink | 0777, link: filepath.ToSlash(target)}, nil)
+}
+
+func (a *archiveFS) exists(path string) bool {
+	name, err := a.entryName(path)
+	return err == nil && a.names[name]
+}
+
+func (a *archiveFS) local(path string) (string, error) {
+	name, err := a.entryName(path)
+	if err != nil {
+		return "", err
+	}
+	local := filepath.Join(a.spool, filepath.FromSlash(name))
+	if err = os.MkdirAll(filepath.Dir(local), defaultDirPerm); err != nil {
+		return "", err
+	}
+	a.spooled = append(a.spooled, name)
+	return local, nil
+}
+
+// close adds the spooled files and finalises the archive. The files must have
+// been closed.
+func (a *archiveFS) close() (err error) {
+	defer os.RemoveAll(a.spool)
+	defer func() {
+		if err != nil {
+			a.f.Close()
+			os.Remove(a.f.Name())
+		}
+	}()
+
+	for _, name := range a.spooled {
+		if err = a.addSpooled(name); err != nil {
+			return err
+		}
+	}
+	if a.err != nil {
+		return a.err
+	}
+	if err = a.w.close(); err != nil {
+		return err
+	}
+	if a.durable {
+		if err = a.f.Sync(); err != nil {
+			return err
+		}
+	}
+	if err = a.f.Close(); err != nil {
+		return err
+	}
+	if err = os.Chmod(a.f.Name(), 0644); err != nil {
+		return err
+	}
+	if err = os.Rename(a.f.Name(), a.path); err != nil {
+		return err
+	}
+	if a.durable {
+		return syncDir(filepath.Dir(a.path))
+	}
+	return nil
+}
+
+func (a *archiveFS) addSpooled(name string) error {
+	f, err := os.Open(filepath.Join(a.spool, filepath.FromSlash(name)))
+	if os.IsNotExist(err) {
+		// never created
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return a.add(archiveEntry{
+		name:    name,
+		mode:    info.Mode().Perm(),
+		size:    info.Size(),
+		modTime: info.ModTime(),
+	}, f)
+}
+
+// ExtractArchive extracts an archive written by certgrep, a .tar.zst or a
+// .zip file, to dir. Entries that would end up outside of dir, including
+// symlinks pointing out of it and entries below a symlink, are refused, as
+// are entries overwriting existing files.
+func ExtractArchive(archive, dir string) error {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	switch {
+	case strings.HasSuffix(archive, "."+ArchiveTarZstd):
+		return extractTar(archive, dir)
+	case strings.HasSuffix(archive, "."+ArchiveZip):
+		return extractZip(archive, dir)
+	}
+	return fmt.Errorf("unknown archive format: %s", archive)
+}
+
+func extractTar(archive, dir string) error {
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	zst, err := zstd.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer zst.Close()
+
+	tr := tar.NewReader(zst)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		entry := archiveEntry{
+			name: hdr.Name,
+			mode: os.FileMode(hdr.Mode).Perm(),
+			link: hdr.Linkname,
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			entry.mode |= os.ModeDir
+		case tar.TypeSymlink:
+			entry.mode |= os.ModeSymlink
+		case tar.TypeReg:
+		default:
+			continue
+		}
+		if err = extractEntry(dir, entry, tr); err != nil {
+			return err
+		}
+	}
+}
+
+func extractZip(archive, dir string) error {
+	zr, err := zip.OpenReader(archive)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	for _, f := range zr.File {
+		entry := archiveEntry{name: f.Name, mode: f.Mode()}
+		if err := extractZipEntry(dir, entry, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func extractZipEntry(dir string, entry archiveEntry, f *zip.File) error {
+	r, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if entry.mode&os.ModeSymlink != 0 {
+		link, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		entry.link = string(link)
+	}
+	return extractEntry(dir, entry, r)
+}
+
+func extractEntry(dir string, entry archiveEntry, r io.Reader) error {
+	path := filepath.Join(dir, filepath.FromSlash(entry.name))
+	if !within(dir, path) {
+		return fmt.Errorf("%s: entry outside of the extraction directory", entry.name)
+	}
+	// a symlink extracted earlier, checked against its lexical target only,
+	// could lead anywhere
+	if err := noSymlinkParents(dir, path); err != nil {
+		return fmt.Errorf("%s: %v", entry.name, err)
+	}
+
+	switch {
+	case entry.mode.IsDir():
+		return os.MkdirAll(path, defaultDirPerm)
+	case entry.mode&os.ModeSymlink != 0:
+		link := filepath.FromSlash(entry.link)
+		if filepath.IsAbs(link) || !within(dir, filepath.Join(filepath.Dir(path), link)) {
+			return fmt.Errorf("%s: symlink outside of the extraction directory", entry.name)
+		}
+		if err := os.MkdirAll(filepath.Dir(path), defaultDirPerm); err != nil {
+			return err
+		}
+		return os.Symlink(link, path)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), defaultDirPerm); err != nil {
+		return err
+	}
+	// O_EXCL doesn't follow a symlink in place of the file either
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, entry.mode.Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// noSymlinkParents returns an error if one of the existing directories
+// between dir and path is a symlink.
+func noSymlinkParents(dir, path string) error {
+	rel, err := filepath.Rel(dir, filepath.Dir(path))
+	if err != nil || rel == "." {
+		return err
+	}
+	parent := dir
+	for _, name := range strings.Split(rel, string(filepath.Separator)) {
+		parent = filepath.Join(parent, name)
+		info, err := os.Lstat(parent)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("below the symlink %s", parent)
+		}
+	}
+	return nil
+}
+
+// within reports whether path is dir or below it.
+func within(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
@@ -0,0 +1,168 @@
+package certgrep
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExtractArchive(t *testing.T) {
+	const capture = "testdata/sess_test_1.pcapng"
+	run, _ := extract(t, capture, IndexTrees(true))
+	want := readTree(t, run)
+
+	for _, format := range []string{ArchiveTarZstd, ArchiveZip} {
+		t.Run(format, func(t *testing.T) {
+			archive, _ := extract(t, capture, IndexTrees(true), Archive(format))
+			if !strings.HasSuffix(archive, "."+format) {
+				t.Fatalf("run written to %s", archive)
+			}
+			dir := t.TempDir()
+			if err := ExtractArchive(archive, dir); err != nil {
+				t.Fatal(err)
+			}
+			runs, err := ioutil.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(runs) != 1 {
+				t.Fatalf("%d run directories extracted, want 1", len(runs))
+			}
+			got := readTree(t, filepath.Join(dir, runs[0].Name()))
+
+			var links int
+			for name, data := range want {
+				if bytes.HasPrefix(data, []byte("-> ")) {
+					links++
+				}
+				if !bytes.Equal(got[name], data) {
+					t.Errorf("%s differs from the run written to disk", name)
+				}
+			}
+			if len(got) != len(want) {
+				t.Errorf("%d files extracted, want %d", len(got), len(want))
+			}
+			if links == 0 {
+				t.Error("no symlinks in the index trees")
+			}
+
+			// extracting again doesn't overwrite anything
+			if err = ExtractArchive(archive, dir); err == nil {
+				t.Error("extracted over existing files")
+			}
+		})
+	}
+}
+
+// writeArchive writes entries, with the content of files, to an archive of
+// format in dir.
+func writeArchive(t *testing.T, dir, format string, entries []archiveEntry) string {
+	t.Helper()
+	path := filepath.Join(dir, "evil."+format)
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var w archiveWriter = &zipArchive{zw: zip.NewWriter(f)}
+	if format == ArchiveTarZstd {
+		if w, err = newTarArchive(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, entry := range entries {
+		content := "escaped"
+		entry.size = int64(len(content))
+		if err = w.add(entry, strings.NewReader(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = w.close(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestExtractArchiveTraversal(t *testing.T) {
+	file := func(name string) archiveEntry { return archiveEntry{name: name, mode: 0644} }
+	link := func(name, target string) archiveEntry {
+		return archiveEntry{name: name, mode: os.ModeSymlink | 0777, link: target}
+	}
+	tests := []struct {
+		name    string
+		entries []archiveEntry
+		// a file planted in the extraction directory beforehand
+		existing string
+	}{
+		{name: "dot dot", entries: []archiveEntry{file("../escaped")}},
+		{name: "absolute symlink", entries: []archiveEntry{link("l", "/tmp")}},
+		{name: "symlink out", entries: []archiveEntry{link("d/l", "../..")}},
+		{
+			// each link lexically within the directory, the second one
+			// resolved through the first
+			name: "chained symlinks",
+			entries: []archiveEntry{
+				link("d/l", ".."),
+				link("d/l/l2", ".."),
+				file("d/l/l2/escaped"),
+			},
+		},
+		{
+			name:     "file written through a symlink",
+			entries:  []archiveEntry{link("d/l", "../target"), file("d/l")},
+			existing: "target",
+		},
+		{
+			name:     "existing file",
+			entries:  []archiveEntry{file("target")},
+			existing: "target",
+		},
+	}
+	for _, format := range []string{ArchiveTarZstd, ArchiveZip} {
+		for _, tt := range tests {
+			t.Run(format+"/"+tt.name, func(t *testing.T) {
+				tmp := t.TempDir()
+				archive := writeArchive(t, tmp, format, tt.entries)
+				// the extraction directory two levels down, the links have
+				// something to escape to
+				dir := filepath.Join(tmp, "a", "b")
+				if err := os.MkdirAll(dir, defaultDirPerm); err != nil {
+					t.Fatal(err)
+				}
+				if tt.existing != "" {
+					err := ioutil.WriteFile(filepath.Join(dir, tt.existing), []byte("kept"), 0644)
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				if err := ExtractArchive(archive, dir); err == nil {
+					t.Error("no error")
+				}
+				err := filepath.Walk(tmp, func(path string, info os.FileInfo, err error) error {
+					if err != nil || info.Mode()&os.ModeSymlink != 0 {
+						return err
+					}
+					if !info.IsDir() && !within(dir, path) && path != archive {
+						if data, _ := ioutil.ReadFile(path); string(data) == "escaped" {
+							t.Errorf("written to %s", path)
+						}
+					}
+					return nil
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if tt.existing != "" {
+					if data, _ := ioutil.ReadFile(filepath.Join(dir, tt.existing)); string(data) != "kept" {
+						t.Errorf("%s overwritten", tt.existing)
+					}
+				}
+			})
+		}
+	}
+}
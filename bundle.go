@@ -0,0 +1,231 @@
+package certgrep
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"path/filepath"
+)
+
+const bundleManifestFile = "manifest.json"
+
+var (
+	oidPKCS7Data       = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidPKCS7SignedData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+)
+
+// bundleWriter writes every distinct chain once, to a directory named after
+// its chainHash:
+//
+//	chain.pem      the chain as sent by the server, leaf first
+//	fullchain.pem  the issuance path from the leaf, following signatures
+//	chain.p7b      the chain as a degenerate PKCS#7 SignedData (DER)
+//	manifest.json  the chain's certificates and where their files are
+type bundleWriter struct {
+	dir string
+	// nested like the store, two hex digits first
+	nested bool
+	// certDir locates the per certificate files, nil if none are written
+	certDir func(*x509.Certificate) string
+	fs      fileSystem
+	// bundles complete on disk, a failed one is tried again with the next
+	// sighting of its chain
+	written map[string]bool
+}
+
+// bundleManifest describes a chain bundle.
+type bundleManifest struct {
+	ChainHash    string              `json:"chain_hash"`
+	Length       int                 `json:"length"`
+	FullChain    []int               `json:"fullchain"`
+	Certificates []bundleCertificate `json:"certificates"`
+}
+
+type bundleCertificate struct {
+	Position int    `json:"position"`
+	SHA1     string `json:"sha1"`
+	SHA256   string `json:"sha256"`
+	Subject  string `json:"subject"`
+	Issuer   string `json:"issuer"`
+	// relative to the bundle
+	Path string `json:"path,omitempty"`
+}
+
+func (w *bundleWriter) bundleDir(hash string) string {
+	if w.nested {
+		return filepath.Join(w.dir, "chains", hash[0:2], hash)
+	}
+	return filepath.Join(w.dir, "chains", hash)
+}
+
+func (w *bundleWriter) Observe(_ context.Context, obs Observation) error {
+	if len(obs.Chain) == 0 {
+		return nil
+	}
+	hash := chainHash(obs.Chain)
+	dir := w.bundleDir(hash)
+	if w.written[dir] {
+		return nil
+	}
+	if w.fs.exists(filepath.Join(dir, bundleManifestFile)) {
+		// written by an earlier run
+		w.written[dir] = true
+		return nil
+	}
+
+	if err := w.fs.mkdirAll(dir); err != nil {
+		return err
+	}
+
+	path := issuancePath(obs.Chain)
+	manifest := bundleManifest{
+		ChainHash:    hash,
+		Length:       len(obs.Chain),
+		FullChain:    path,
+		Certificates: make([]bundleCertificate, len(obs.Chain)),
+	}
+	for i, cert := range obs.Chain {
+		sum1 := sha1.Sum(cert.Raw)
+		sum256 := sha256.Sum256(cert.Raw)
+		entry := bundleCertificate{
+			Position: i,
+			SHA1:     hex.EncodeToString(sum1[:]),
+			SHA256:   hex.EncodeToString(sum256[:]),
+			Subject:  cert.Subject.String(),
+			Issuer:   cert.Issuer.String(),
+		}
+		if w.certDir != nil {
+			// empty if writing the certificate's files failed and was skipped
+			if certDir := w.certDir(cert); certDir != "" {
+				rel, err := filepath.Rel(dir, certDir)
+				if err != nil {
+					return err
+				}
+				entry.Path = filepath.ToSlash(rel)
+			}
+		}
+		manifest.Certificates[i] = entry
+	}
+
+	fullchain := make([]*x509.Certificate, len(path))
+	for i, pos := range path {
+		fullchain[i] = obs.Chain[pos]
+	}
+
+	p7b, err := pkcs7Certificates(obs.Chain)
+	if err != nil {
+		return err
+	}
+	raw, err := json.MarshalIndent(&manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	for _, file := range []struct {
+		name string
+		data []byte
+	}{
+		{"chain.pem", pemCertificates(obs.Chain)},
+		{"fullchain.pem", pemCertificates(fullchain)},
+		{"chain.p7b", p7b},
+		// last, its presence marks a complete bundle
+		{bundleManifestFile, raw},
+	} {
+		if err := w.fs.writeFile(filepath.Join(dir, file.name), file.data, 0644); err != nil {
+			return err
+		}
+	}
+	w.written[dir] = true
+	return nil
+}
+
+func (w *bundleWriter) Close() error {
+	return nil
+}
+
+// issuancePath returns the positions of the certificates on the path from
+// the leaf towards the root, following issuer signatures. Servers send
+// certificates in the wrong order or extra ones often enough.
+func issuancePath(certs []*x509.Certificate) []int {
+	path := []int{0}
+	used := map[int]bool{0: true}
+	for current := certs[0]; ; {
+		next := -1
+		for i, cert := range certs {
+			if used[i] || !bytes.Equal(current.RawIssuer, cert.RawSubject) {
+				continue
+			}
+			// CheckSignatureFrom refuses SHA-1, which old chains still use
+			err := cert.CheckSignature(current.SignatureAlgorithm,
+				current.RawTBSCertificate, current.Signature)
+			if err == nil {
+				next = i
+				break
+			}
+		}
+		if next < 0 {
+			return path
+		}
+		path = append(path, next)
+		used[next] = true
+		current = certs[next]
+	}
+}
+
+func pemCertificates(certs []*x509.Certificate) []byte {
+	var buf bytes.Buffer
+	for _, cert := range certs {
+		pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	}
+	return buf.Bytes()
+}
+
+// pkcs7Certificates encodes certs as a PKCS#7 SignedData without signers, the
+// "certs-only" format of .p7b files (RFC 2315).
+func pkcs7Certificates(certs []*x509.Certificate) ([]byte, error) {
+	var raw []byte
+	for _, cert := range certs {
+		raw = append(raw, cert.Raw...)
+	}
+
+	signedData, err := asn1.Marshal(struct {
+		Version          int
+		DigestAlgorithms []asn1.RawValue `asn1:"set"`
+		ContentInfo      struct{ ContentType asn1.ObjectIdentifier }
+		Certificates     asn1.RawValue
+		SignerInfos      []asn1.RawValue `asn1:"set"`
+	}{
+		Version:          1,
+		DigestAlgorithms: []asn1.RawValue{},
+		ContentInfo:      struct{ ContentType asn1.ObjectIdentifier }{oidPKCS7Data},
+		Certificates: asn1.RawValue{
+			Class:      asn1.ClassContextSpecific,
+			Tag:        0,
+			IsCompound: true,
+			Bytes:      raw,
+		},
+		SignerInfos: []asn1.RawValue{},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return asn1.Marshal(struct {
+		ContentType asn1.ObjectIdentifier
+		Content     asn1.RawValue
+	}{
+		ContentType: oidPKCS7SignedData,
+		Content: asn1.RawValue{
+			Class:      asn1.ClassContextSpecific,
+			Tag:        0,
+			IsCompound: true,
+			Bytes:      signedData,
+		},
+	})
+}
@@ -0,0 +1,340 @@
+package certgrep
+
+import (
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"time"
+)
+
+// Certificate is certgrep's own representation of an X.509 certificate. Unlike
+// x509.Certificate it is meant to be read by humans and other tools: keys,
+// algorithms, usages and extensions are decoded by name, and its JSON encoding
+// doesn't depend on the Go version.
+type Certificate struct {
+	Version            int       `json:"version"`
+	SerialNumber       string    `json:"serial_number"`
+	SerialNumberHex    string    `json:"serial_number_hex"`
+	SignatureAlgorithm string    `json:"signature_algorithm"`
+	Issuer             Name      `json:"issuer"`
+	Subject            Name      `json:"subject"`
+	NotBefore          time.Time `json:"not_before"`
+	NotAfter           time.Time `json:"not_after"`
+	PublicKey          PublicKey `json:"public_key"`
+
+	KeyUsage         []string          `json:"key_usage"`
+	ExtKeyUsage      []string          `json:"ext_key_usage"`
+	BasicConstraints *BasicConstraints `json:"basic_constraints,omitempty"`
+	SubjectAltNames  SubjectAltNames   `json:"subject_alt_names"`
+	SubjectKeyID     string            `json:"subject_key_id,omitempty"`
+	AuthorityKeyID   string            `json:"authority_key_id,omitempty"`
+	Policies         []Policy          `json:"policies"`
+
+	AuthorityInfoAccess   AuthorityInfoAccess `json:"authority_info_access"`
+	CRLDistributionPoints []string            `json:"crl_distribution_points"`
+	NameConstraints       *NameConstraints    `json:"name_constraints,omitempty"`
+	Extensions            []Extension         `json:"extensions"`
+
+	Fingerprints Fingerprints `json:"fingerprints"`
+}
+
+// Name is a distinguished name.
+type Name struct {
+	DN                 string   `json:"dn"`
+	CommonName         string   `json:"common_name,omitempty"`
+	SerialNumber       string   `json:"serial_number,omitempty"`
+	Organization       []string `json:"organization,omitempty"`
+	OrganizationalUnit []string `json:"organizational_unit,omitempty"`
+	Country            []string `json:"country,omitempty"`
+	Province           []string `json:"province,omitempty"`
+	Locality           []string `json:"locality,omitempty"`
+	StreetAddress      []string `json:"street_address,omitempty"`
+	PostalCode         []string `json:"postal_code,omitempty"`
+}
+
+// PublicKey describes the subject's public key.
+type PublicKey struct {
+	Algorithm string `json:"algorithm"`
+	Size      int    `json:"size"`
+	Curve     string `json:"curve,omitempty"`
+	Exponent  int    `json:"exponent,omitempty"`
+}
+
+type BasicConstraints struct {
+	IsCA       bool `json:"is_ca"`
+	MaxPathLen *int `json:"max_path_len,omitempty"`
+}
+
+type SubjectAltNames struct {
+	DNSNames       []string `json:"dns_names"`
+	IPAddresses    []string `json:"ip_addresses"`
+	EmailAddresses []string `json:"email_addresses"`
+	URIs           []string `json:"uris"`
+}
+
+type Policy struct {
+	OID  string `json:"oid"`
+	Name string `json:"name,omitempty"`
+}
+
+type AuthorityInfoAccess struct {
+	OCSPServers           []string `json:"ocsp_servers"`
+	IssuingCertificateURL []string `json:"issuing_certificate_url"`
+}
+
+type NameConstraints struct {
+	Critical            bool     `json:"critical"`
+	PermittedDNSDomains []string `json:"permitted_dns_domains,omitempty"`
+	ExcludedDNSDomains  []string `json:"excluded_dns_domains,omitempty"`
+	PermittedIPRanges   []string `json:"permitted_ip_ranges,omitempty"`
+	ExcludedIPRanges    []string `json:"excluded_ip_ranges,omitempty"`
+	PermittedEmails     []string `json:"permitted_email_addresses,omitempty"`
+	ExcludedEmails      []string `json:"excluded_email_addresses,omitempty"`
+	PermittedURIDomains []string `json:"permitted_uri_domains,omitempty"`
+	ExcludedURIDomains  []string `json:"excluded_uri_domains,omitempty"`
+}
+
+// Extension lists an extension present in the certificate. Known extensions
+// are decoded into the other fields of Certificate.
+type Extension struct {
+	OID      string `json:"oid"`
+	Name     string `json:"name,omitempty"`
+	Critical bool   `json:"critical"`
+}
+
+type Fingerprints struct {
+	SHA1       string `json:"sha1"`
+	SHA256     string `json:"sha256"`
+	SPKISHA256 string `json:"spki_sha256"`
+}
+
+var (
+	keyUsageNames = []struct {
+		usage x509.KeyUsage
+		name  string
+	}{
+		{x509.KeyUsageDigitalSignature, "digitalSignature"},
+		{x509.KeyUsageContentCommitment, "contentCommitment"},
+		{x509.KeyUsageKeyEncipherment, "keyEncipherment"},
+		{x509.KeyUsageDataEncipherment, "dataEncipherment"},
+		{x509.KeyUsageKeyAgreement, "keyAgreement"},
+		{x509.KeyUsageCertSign, "keyCertSign"},
+		{x509.KeyUsageCRLSign, "cRLSign"},
+		{x509.KeyUsageEncipherOnly, "encipherOnly"},
+		{x509.KeyUsageDecipherOnly, "decipherOnly"},
+	}
+
+	extKeyUsageNames = map[x509.ExtKeyUsage]string{
+		x509.ExtKeyUsageAny:                            "any",
+		x509.ExtKeyUsageServerAuth:                     "serverAuth",
+		x509.ExtKeyUsageClientAuth:                     "clientAuth",
+		x509.ExtKeyUsageCodeSigning:                    "codeSigning",
+		x509.ExtKeyUsageEmailProtection:                "emailProtection",
+		x509.ExtKeyUsageIPSECEndSystem:                 "ipsecEndSystem",
+		x509.ExtKeyUsageIPSECTunnel:                    "ipsecTunnel",
+		x509.ExtKeyUsageIPSECUser:                      "ipsecUser",
+		x509.ExtKeyUsageTimeStamping:                   "timeStamping",
+		x509.ExtKeyUsageOCSPSigning:                    "OCSPSigning",
+		x509.ExtKeyUsageMicrosoftServerGatedCrypto:     "msSGC",
+		x509.ExtKeyUsageNetscapeServerGatedCrypto:      "nsSGC",
+		x509.ExtKeyUsageMicrosoftCommercialCodeSigning: "msCodeCom",
+		x509.ExtKeyUsageMicrosoftKernelCodeSigning:     "msKernelCode",
+	}
+
+	extensionNames = map[string]string{
+		"2.5.29.14":               "subjectKeyIdentifier",
+		"2.5.29.15":               "keyUsage",
+		"2.5.29.17":               "subjectAltName",
+		"2.5.29.18":               "issuerAltName",
+		"2.5.29.19":               "basicConstraints",
+		"2.5.29.30":               "nameConstraints",
+		"2.5.29.31":               "cRLDistributionPoints",
+		"2.5.29.32":               "certificatePolicies",
+		"2.5.29.33":               "policyMappings",
+		"2.5.29.35":               "authorityKeyIdentifier",
+		"2.5.29.36":               "policyConstraints",
+		"2.5.29.37":               "extKeyUsage",
+		"2.5.29.54":               "inhibitAnyPolicy",
+		"1.3.6.1.5.5.7.1.1":       "authorityInfoAccess",
+		"1.3.6.1.5.5.7.1.11":      "subjectInfoAccess",
+		"1.3.6.1.5.5.7.1.24":      "tlsFeature",
+		"1.3.6.1.4.1.11129.2.4.2": "ctPrecertificateSCTs",
+		"1.3.6.1.4.1.11129.2.4.3": "ctPrecertificatePoison",
+		"2.16.840.1.113730.1.1":   "netscapeCertType",
+		"2.16.840.1.113730.1.13":  "netscapeComment",
+		"1.3.6.1.4.1.311.20.2":    "msCertificateTemplateName",
+		"1.3.6.1.4.1.311.21.7":    "msCertificateTemplate",
+		"1.3.6.1.4.1.311.21.10":   "msApplicationPolicies",
+	}
+
+	policyNames = map[string]string{
+		"2.5.29.32.0":    "anyPolicy",
+		"2.23.140.1.1":   "extendedValidation",
+		"2.23.140.1.2.1": "domainValidated",
+		"2.23.140.1.2.2": "organizationValidated",
+		"2.23.140.1.2.3": "individualValidated",
+		"2.23.140.1.3":   "extendedValidationCodeSigning",
+	}
+)
+
+// NewCertificate builds the certgrep representation of cert.
+func NewCertificate(cert *x509.Certificate) *Certificate {
+	c := &Certificate{
+		Version:            cert.Version,
+		SerialNumber:       cert.SerialNumber.String(),
+		SerialNumberHex:    cert.SerialNumber.Text(16),
+		SignatureAlgorithm: cert.SignatureAlgorithm.String(),
+		Issuer:             newName(cert.Issuer),
+		Subject:            newName(cert.Subject),
+		NotBefore:          cert.NotBefore.UTC(),
+		NotAfter:           cert.NotAfter.UTC(),
+		PublicKey:          newPublicKey(cert),
+		KeyUsage:           []string{},
+		ExtKeyUsage:        []string{},
+		SubjectAltNames: SubjectAltNames{
+			DNSNames:       nonNil(cert.DNSNames),
+			IPAddresses:    []string{},
+			EmailAddresses: nonNil(cert.EmailAddresses),
+			URIs:           []string{},
+		},
+		SubjectKeyID:   hex.EncodeToString(cert.SubjectKeyId),
+		AuthorityKeyID: hex.EncodeToString(cert.AuthorityKeyId),
+		Policies:       []Policy{},
+		AuthorityInfoAccess: AuthorityInfoAccess{
+			OCSPServers:           nonNil(cert.OCSPServer),
+			IssuingCertificateURL: nonNil(cert.IssuingCertificateURL),
+		},
+		CRLDistributionPoints: nonNil(cert.CRLDistributionPoints),
+		Extensions:            []Extension{},
+	}
+
+	for _, ku := range keyUsageNames {
+		if cert.KeyUsage&ku.usage != 0 {
+			c.KeyUsage = append(c.KeyUsage, ku.name)
+		}
+	}
+
+	for _, eku := range cert.ExtKeyUsage {
+		if name, ok := extKeyUsageNames[eku]; ok {
+			c.ExtKeyUsage = append(c.ExtKeyUsage, name)
+		}
+	}
+	for _, oid := range cert.UnknownExtKeyUsage {
+		c.ExtKeyUsage = append(c.ExtKeyUsage, oid.String())
+	}
+
+	if cert.BasicConstraintsValid {
+		c.BasicConstraints = &BasicConstraints{IsCA: cert.IsCA}
+		if cert.MaxPathLen > 0 || cert.MaxPathLenZero {
+			n := cert.MaxPathLen
+			c.BasicConstraints.MaxPathLen = &n
+		}
+	}
+
+	for _, ip := range cert.IPAddresses {
+		c.SubjectAltNames.IPAddresses = append(c.SubjectAltNames.IPAddresses, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		c.SubjectAltNames.URIs = append(c.SubjectAltNames.URIs, uri.String())
+	}
+
+	for _, oid := range cert.PolicyIdentifiers {
+		c.Policies = append(c.Policies, Policy{
+			OID:  oid.String(),
+			Name: policyNames[oid.String()],
+		})
+	}
+
+	c.NameConstraints = newNameConstraints(cert)
+
+	for _, ext := range cert.Extensions {
+		c.Extensions = append(c.Extensions, Extension{
+			OID:      ext.Id.String(),
+			Name:     extensionNames[ext.Id.String()],
+			Critical: ext.Critical,
+		})
+	}
+
+	sum1 := sha1.Sum(cert.Raw)
+	sum256 := sha256.Sum256(cert.Raw)
+	spki := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	c.Fingerprints = Fingerprints{
+		SHA1:       hex.EncodeToString(sum1[:]),
+		SHA256:     hex.EncodeToString(sum256[:]),
+		SPKISHA256: hex.EncodeToString(spki[:]),
+	}
+
+	return c
+}
+
+func newName(name pkix.Name) Name {
+	return Name{
+		DN:                 name.String(),
+		CommonName:         name.CommonName,
+		SerialNumber:       name.SerialNumber,
+		Organization:       name.Organization,
+		OrganizationalUnit: name.OrganizationalUnit,
+		Country:            name.Country,
+		Province:           name.Province,
+		Locality:           name.Locality,
+		StreetAddress:      name.StreetAddress,
+		PostalCode:         name.PostalCode,
+	}
+}
+
+func newPublicKey(cert *x509.Certificate) PublicKey {
+	pk := PublicKey{Algorithm: cert.PublicKeyAlgorithm.String()}
+	switch key := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		pk.Size = key.N.BitLen()
+		pk.Exponent = key.E
+	case *ecdsa.PublicKey:
+		pk.Size = key.Params().BitSize
+		pk.Curve = key.Params().Name
+	case ed25519.PublicKey:
+		pk.Size = 8 * len(key)
+		pk.Curve = "Ed25519"
+	case *dsa.PublicKey:
+		pk.Size = key.P.BitLen()
+	}
+	return pk
+}
+
+func newNameConstraints(cert *x509.Certificate) *NameConstraints {
+	nc := &NameConstraints{
+		Critical:            cert.PermittedDNSDomainsCritical,
+		PermittedDNSDomains: cert.PermittedDNSDomains,
+		ExcludedDNSDomains:  cert.ExcludedDNSDomains,
+		PermittedEmails:     cert.PermittedEmailAddresses,
+		ExcludedEmails:      cert.ExcludedEmailAddresses,
+		PermittedURIDomains: cert.PermittedURIDomains,
+		ExcludedURIDomains:  cert.ExcludedURIDomains,
+	}
+	for _, ipnet := range cert.PermittedIPRanges {
+		nc.PermittedIPRanges = append(nc.PermittedIPRanges, ipnet.String())
+	}
+	for _, ipnet := range cert.ExcludedIPRanges {
+		nc.ExcludedIPRanges = append(nc.ExcludedIPRanges, ipnet.String())
+	}
+
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(asn1.ObjectIdentifier{2, 5, 29, 30}) {
+			return nc
+		}
+	}
+	return nil
+}
+
+func nonNil(list []string) []string {
+	if list == nil {
+		return []string{}
+	}
+	return list
+}
@@ -0,0 +1,32 @@
+package certgrep
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+)
+
+func TestNewCertificate(t *testing.T) {
+	const name = "testdata/00000014-00-108.160.166.148-443-www.dropbox.com"
+	raw, err := ioutil.ReadFile(name + ".der")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := ioutil.ReadFile(name + ".json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := json.MarshalIndent(NewCertificate(cert), "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, bytes.TrimSpace(want)) {
+		t.Errorf("NewCertificate(%s.der) doesn't match %s.json:\n%s", name, name, got)
+	}
+}
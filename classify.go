@@ -0,0 +1,164 @@
+package certgrep
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// verdict is the pre-assembly classification of a flow direction, based on
+// the first payload carrying segment seen for it.
+type verdict int
+
+const (
+	verdictUnknown verdict = iota
+	verdictTLS
+	verdictSTARTTLS
+	verdictProxy
+	verdictReject
+)
+
+func (v verdict) String() string {
+	switch v {
+	case verdictTLS:
+		return "tls"
+	case verdictSTARTTLS:
+		return "starttls"
+	case verdictProxy:
+		return "proxy"
+	case verdictReject:
+		return "reject"
+	}
+	return "unknown"
+}
+
+const (
+	// the longest PROXY protocol v1 header, including CRLF
+	maxProxyV1Len = 107
+	// how much plaintext is skipped while looking for the TLS handshake
+	// following a STARTTLS exchange
+	maxSTARTTLSPreamble = 64 * 1024
+)
+
+// TLSHandshakeBPF only matches the TCP control segments needed by the
+// assembler and segments whose payload starts with a TLS handshake record.
+// Segments continuing a record are not matched, so certificate chains spread
+// over several segments will be lost, as are STARTTLS and PROXY protocol
+// connections. It trades completeness for CPU on links that can't be
+// processed otherwise, classifyPayload is the lossless default.
+const TLSHandshakeBPF = "tcp[tcpflags] & (tcp-syn|tcp-fin|tcp-rst) != 0 or tcp[((tcp[12:1] & 0xf0) >> 2):1] = 0x16"
+
+var (
+	proxyV1Sig = []byte("PROXY ")
+	proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+	// server greetings of protocols that can be upgraded with STARTTLS, and
+	// the client commands leading up to it
+	starttlsPrefixes = [][]byte{
+		[]byte("220 "), // SMTP, FTP
+		[]byte("220-"),
+		[]byte("* OK"), // IMAP
+		[]byte("+OK"),  // POP3
+		[]byte("EHLO "),
+		[]byte("HELO "),
+		[]byte("STARTTLS"),
+		[]byte("STLS"),
+		[]byte("CAPA"),
+		[]byte("AUTH TLS"),
+	}
+)
+
+// TLSHandshakeFilter restricts an existing capture filter with
+// TLSHandshakeBPF.
+func TLSHandshakeFilter(bpf string) string {
+	if bpf == "" {
+		return TLSHandshakeBPF
+	}
+	return fmt.Sprintf("(%s) and (%s)", bpf, TLSHandshakeBPF)
+}
+
+func isTLSRecord(payload []byte) bool {
+	if len(payload) == 0 || payload[0] != 0x16 {
+		return false
+	}
+	return len(payload) < 2 || payload[1] == 0x03
+}
+
+// classifyPayload looks at the first payload of a flow direction. It must be
+// cheap, it runs for every new flow before any reassembly happens.
+func classifyPayload(payload []byte) verdict {
+	if isTLSRecord(payload) {
+		return verdictTLS
+	}
+	if bytes.HasPrefix(payload, proxyV1Sig) || bytes.HasPrefix(payload, proxyV2Sig) {
+		return verdictProxy
+	}
+	for _, prefix := range starttlsPrefixes {
+		if bytes.HasPrefix(payload, prefix) {
+			return verdictSTARTTLS
+		}
+	}
+	return verdictReject
+}
+
+// stripPreamble consumes a PROXY protocol header or the plaintext part of a
+// STARTTLS exchange so that the reader is positioned at the first TLS record.
+// If no TLS record is found the reader is left wherever scanning stopped.
+func stripPreamble(r *bufio.Reader) (verdict, error) {
+	head, err := r.Peek(len(proxyV2Sig))
+	if err != nil && len(head) == 0 {
+		return verdictUnknown, err
+	}
+
+	v := classifyPayload(head)
+	switch v {
+	case verdictProxy:
+		return v, stripProxyHeader(r, head)
+	case verdictSTARTTLS:
+		return v, skipToTLSRecord(r)
+	}
+	return v, nil
+}
+
+func stripProxyHeader(r *bufio.Reader, head []byte) error {
+	if bytes.HasPrefix(head, proxyV1Sig) {
+		for n := 0; n < maxProxyV1Len; n++ {
+			b, err := r.ReadByte()
+			if err != nil {
+				return err
+			}
+			if b == '\n' {
+				return nil
+			}
+		}
+		return fmt.Errorf("PROXY header longer than %d bytes", maxProxyV1Len)
+	}
+
+	// v2: 12 byte signature, version/command, family, 2 byte length
+	hdr, err := r.Peek(16)
+	if err != nil {
+		return err
+	}
+	_, err = r.Discard(16 + int(binary.BigEndian.Uint16(hdr[14:16])))
+	return err
+}
+
+func skipToTLSRecord(r *bufio.Reader) error {
+	skipped := 0
+	for skipped < maxSTARTTLSPreamble {
+		next, err := r.Peek(3)
+		if isTLSRecord(next) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		line, err := r.ReadSlice('\n')
+		skipped += len(line)
+		if err != nil && err != bufio.ErrBufferFull {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package certgrep
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestClassifyPayload(t *testing.T) {
+	tests := []struct {
+		payload string
+		want    verdict
+	}{
+		{"\x16\x03\x01\x02\x00\x01", verdictTLS},
+		// a single byte segment
+		{"\x16", verdictTLS},
+		{"\x16\x02", verdictReject},
+		{"PROXY TCP4 10.0.0.1 10.0.0.2 51000 443\r\n", verdictProxy},
+		{"\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x0c", verdictProxy},
+		{"220 mx.example.com ESMTP\r\n", verdictSTARTTLS},
+		{"220-mx.example.com ESMTP\r\n", verdictSTARTTLS},
+		{"* OK IMAP4rev1 ready\r\n", verdictSTARTTLS},
+		{"+OK POP3 ready\r\n", verdictSTARTTLS},
+		{"EHLO client.example.com\r\n", verdictSTARTTLS},
+		{"STARTTLS\r\n", verdictSTARTTLS},
+		{"GET / HTTP/1.1\r\n", verdictReject},
+		{"SSH-2.0-OpenSSH_8.9\r\n", verdictReject},
+		{"", verdictReject},
+	}
+	for _, tt := range tests {
+		if got := classifyPayload([]byte(tt.payload)); got != tt.want {
+			t.Errorf("classifyPayload(%q) = %v, want %v", tt.payload, got, tt.want)
+		}
+	}
+}
+
+func TestStripPreamble(t *testing.T) {
+	const handshake = "\x16\x03\x02\x00\x31\x02"
+	proxyV2 := string(proxyV2Sig) + "\x21\x11\x00\x0c" + strings.Repeat("\x01", 12)
+	tests := []struct {
+		name    string
+		stream  string
+		verdict verdict
+		err     bool
+		rest    string
+	}{
+		{name: "tls", stream: handshake, verdict: verdictTLS, rest: handshake},
+		{
+			name:    "proxy v1",
+			stream:  "PROXY TCP4 10.0.0.1 10.0.0.2 443 51000\r\n" + handshake,
+			verdict: verdictProxy,
+			rest:    handshake,
+		},
+		{name: "proxy v2", stream: proxyV2 + handshake, verdict: verdictProxy, rest: handshake},
+		{
+			name:    "proxy v1 too long",
+			stream:  "PROXY " + strings.Repeat("x", maxProxyV1Len) + "\r\n" + handshake,
+			verdict: verdictProxy,
+			err:     true,
+		},
+		{
+			name:    "smtp",
+			stream:  "220 mx ESMTP\r\n250-STARTTLS\r\n250 OK\r\n220 2.0.0 Ready to start TLS\r\n" + handshake,
+			verdict: verdictSTARTTLS,
+			rest:    handshake,
+		},
+		{
+			name:    "starttls refused",
+			stream:  "220 mx ESMTP\r\n454 4.7.0 TLS not available\r\n",
+			verdict: verdictSTARTTLS,
+			err:     true,
+		},
+		{name: "http", stream: "HTTP/1.1 200 OK\r\n\r\n", verdict: verdictReject, rest: "HTTP/1.1 200 OK\r\n\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReader(strings.NewReader(tt.stream))
+			v, err := stripPreamble(r)
+			if v != tt.verdict {
+				t.Errorf("verdict = %v, want %v", v, tt.verdict)
+			}
+			if (err != nil) != tt.err {
+				t.Fatalf("error = %v, want error %v", err, tt.err)
+			}
+			if tt.err {
+				return
+			}
+			rest, _ := ioutil.ReadAll(r)
+			if !bytes.Equal(rest, []byte(tt.rest)) {
+				t.Errorf("left %q, want %q", rest, tt.rest)
+			}
+		})
+	}
+}
+
+func TestTLSHandshakeFilter(t *testing.T) {
+	tests := []struct {
+		bpf  string
+		want string
+	}{
+		{"", TLSHandshakeBPF},
+		{"tcp", "(tcp) and (" + TLSHandshakeBPF + ")"},
+		{"port 443 or port 993", "(port 443 or port 993) and (" + TLSHandshakeBPF + ")"},
+	}
+	for _, tt := range tests {
+		if got := TLSHandshakeFilter(tt.bpf); got != tt.want {
+			t.Errorf("TLSHandshakeFilter(%q) = %q, want %q", tt.bpf, got, tt.want)
+		}
+	}
+}
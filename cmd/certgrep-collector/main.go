@@ -0,0 +1,85 @@
+// certgrep-collector is a minimal collector for certgrep's --webhook, for
+// trying out a sensor setup. It prints the events it receives, one JSON
+// document per line.
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+
+	docopt "github.com/docopt/docopt-go"
+)
+
+var usage = `
+Usage:
+    certgrep-collector [options]
+    certgrep-collector -h | --help
+
+Options:
+    -h --help               Show this screen.
+    -l --listen=<addr>      Address to listen on [default: 127.0.0.1:8080]
+    --token=<token>         Require "Authorization: Bearer <token>"
+    --fail=<n>              Answer the first n batches with 503 Service Unavailable [default: 0]
+`
+
+func main() {
+	args, _ := docopt.Parse(usage, os.Args[1:], true, "", true)
+
+	fail, err := strconv.Atoi(args["--fail"].(string))
+	if err != nil {
+		log.Fatal(err)
+	}
+	var token string
+	if args["--token"] != nil {
+		token = args["--token"].(string)
+	}
+
+	var (
+		mu      sync.Mutex
+		batches int
+		out     = bufio.NewWriter(os.Stdout)
+	)
+
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "POST only", http.StatusMethodNotAllowed)
+			return
+		}
+		if token != "" && r.Header.Get("Authorization") != "Bearer "+token {
+			http.Error(w, "bad token", http.StatusUnauthorized)
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		batches++
+		if batches <= fail {
+			log.Printf("batch %d: failing", batches)
+			http.Error(w, "failing on purpose", http.StatusServiceUnavailable)
+			return
+		}
+
+		events := 0
+		scanner := bufio.NewScanner(r.Body)
+		scanner.Buffer(nil, 16*1024*1024)
+		for scanner.Scan() {
+			fmt.Fprintln(out, scanner.Text())
+			events++
+		}
+		out.Flush()
+		if err := scanner.Err(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("batch %d: %d events", batches, events)
+	})
+
+	addr := args["--listen"].(string)
+	log.Printf("listening on %s", addr)
+	log.Fatal(http.ListenAndServe(addr, nil))
+}
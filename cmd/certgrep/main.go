@@ -1,13 +1,20 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
+	"time"
 
-	"github.com/davecgh/go-spew/spew"
 	docopt "github.com/docopt/docopt-go"
-	"github.com/google/gopacket/pcap"
 	. "github.com/kung-foo/certgrep"
+	"github.com/kung-foo/certgrep/pcapsource"
 	isatty "github.com/mattn/go-isatty"
 	"github.com/pkg/errors"
 	"github.com/pkg/profile"
@@ -26,8 +33,10 @@ var slogger *zap.SugaredLogger
 
 var usage = `
 Usage:
-    certgrep [options] [-v ...] [--format=<format> ...] (-p=<pcap> | -i=<interface>)
+    certgrep [options] [-v ...] [--format=<format> ...] [--webhook-header=<header> ...] (-p=<pcap> | -i=<interface>)
     certgrep [options] [-v ...] -l | --list
+    certgrep [options] extract-archive <archive>
+    certgrep [options] [-v ...] parse-stream <stream>
     certgrep -h | --help | --version
 
 Options:
@@ -37,9 +46,28 @@ Options:
     -p --pcap=<pcap>        PCAP file to parse
     -i --interface=<iface>  Network interface to listen on
     -o --output=<output>    Resource output directory [default: certs]
+    --layout=<layout>       Output directory layout (fingerprint|server|name|issuer) [default: fingerprint]
+    --date-partition        Partition the output directory by capture date
+    --index                 Maintain by-host/, by-issuer/ and by-expiry-month/ symlink trees
+    --archive=<format>      Write the output directory to a single archive (tar.zst|zip)
+    -s --store=<store>      Persistent certificate store shared between runs
+    --fsync                 Sync output files to disk as they are written
+    --on-write-error=<policy>  What to do when writing output fails (abort|retry|skip) [default: abort]
     --log-to-stdout         Write certificate log to stdout
-    -f --format=<format>    Certificate output format (json|der|pem) [default: pem]
+    --log-format=<format>   Certificate log format (text|jsonl) [default: text]
+    --failure-log           Log streams no certificates were extracted from, and why, to failures.jsonl
+    -f --format=<format>    Certificate output format (json|der|pem|text|chain|sqlite|zeek|zeek-json|eve|parquet|stix), pem unless only logging or printing to stdout
+    --db=<db>               SQLite database for the sqlite format, certgrep.db in the output directory if not set
+    --print-flow=<flow>     Print the certificates of a flow (index, hash or server ip:port) to stdout
+    --eve-chain             Add the certificate chain to the tls records of the eve format
+    --parquet-max-size=<mb>  Start new parquet files past this size in MiB, 0 for never [default: 256]
+    --parquet-max-age=<age>  Start new parquet files after this long, 0 for never [default: 1h]
+    --webhook=<url>         POST events in batches to an HTTP collector
+    --webhook-header=<header>  Header sent with every POST, "Name: value"
+    --webhook-spool=<dir>   Directory for batches the collector didn't accept, webhook-spool next to the per run output directories if not set
     -b --bpf=<bpf>          Capture filter (BPF) [default: tcp]
+    --bpf-tls-only          Restrict the capture filter to segments starting a TLS handshake record, drops data
+    --no-prefilter          Disable early classification of flows before reassembly
     --no-color              Disabled colored output
     -v                      Enable verbose logging (-vv for very verbose)
     --profile
@@ -47,6 +75,8 @@ Options:
     --assembly-debug-log
     --dump-metrics
     --dump-packets
+    --hex                   The stream to parse is a hex dump
+    --peer=<peer>           Peer kept of a Wireshark C arrays dump, 1 is the server [default: 1]
 `
 
 // for --assembly-memuse-log and --assembly-debug-log see:
@@ -86,59 +116,170 @@ func mainEx(argv []string) {
 
 	slogger = logger.Sugar()
 
+	if args["extract-archive"].(bool) {
+		onErrorExit(ExtractArchive(args["<archive>"].(string), args["--output"].(string)))
+		return
+	}
+
+	if args["parse-stream"].(bool) {
+		peer, err := strconv.Atoi(args["--peer"].(string))
+		onErrorExit(errors.Wrap(err, "invalid --peer"))
+		onErrorExit(parseStream(args["<stream>"].(string), args["--hex"].(bool), peer))
+		return
+	}
+
 	if args["--list"].(bool) {
-		onErrorExit(PrintDeviceTable(os.Stdout, slogger))
+		onErrorExit(pcapsource.PrintDeviceTable(os.Stdout, slogger))
 		return
 	}
 
-	var handle *pcap.Handle
+	var (
+		handle *pcapsource.Source
+		source string
+	)
 
 	if args["--pcap"] != nil {
-		handle, err = pcap.OpenOffline(args["--pcap"].(string))
+		source = args["--pcap"].(string)
+		handle, err = pcapsource.OpenOffline(source)
 		onErrorExit(err)
 	}
 
 	if args["--interface"] != nil {
-		handle, err = pcap.OpenLive(args["--interface"].(string), snaplen, true, pcap.BlockForever)
+		source = args["--interface"].(string)
+		handle, err = pcapsource.OpenLive(source, snaplen, true)
 		if err != nil {
 			slogger.Info("Run --list to view available capture interfaces.")
 			onErrorExit(err)
 		}
 	}
 
-	if err = handle.SetBPFFilter(args["--bpf"].(string)); err != nil {
-		onErrorExit(errors.Wrap(err, "error setting BPF filter"))
+	bpf := args["--bpf"].(string)
+	if args["--bpf-tls-only"].(bool) {
+		bpf = TLSHandshakeFilter(bpf)
+		slogger.Debugf("capture filter: %s", bpf)
 	}
 
 	var extractor *Extractor
 
 	options := make([]Option, 0)
 
-	if args["--format"] != nil {
-		for _, format := range args["--format"].([]string) {
-			options = append(options, EnableOutputFormat(format, true))
-		}
+	formats := args["--format"].([]string)
+	if len(formats) == 0 && !args["--log-to-stdout"].(bool) && args["--print-flow"] == nil {
+		formats = []string{"pem"}
+	}
+	for _, format := range formats {
+		options = append(options, EnableOutputFormat(format, true))
 	}
 
 	options = append(options, Logger(slogger))
 	options = append(options, OutputDir(args["--output"].(string)))
 	options = append(options, LogToStdout(args["--log-to-stdout"].(bool)))
+	options = append(options, LogFormat(args["--log-format"].(string)))
+	options = append(options, Prefilter(!args["--no-prefilter"].(bool)))
+	options = append(options, CaptureSource(source))
+	options = append(options, CaptureFilter(bpf))
+	options = append(options, EVEChain(args["--eve-chain"].(bool)))
+	options = append(options, Layout(args["--layout"].(string)))
+	options = append(options, DatePartition(args["--date-partition"].(bool)))
+	options = append(options, IndexTrees(args["--index"].(bool)))
+	maxSize, err := strconv.ParseInt(args["--parquet-max-size"].(string), 10, 64)
+	onErrorExit(errors.Wrap(err, "invalid --parquet-max-size"))
+	maxAge, err := time.ParseDuration(args["--parquet-max-age"].(string))
+	onErrorExit(errors.Wrap(err, "invalid --parquet-max-age"))
+	options = append(options, ParquetRollover(maxSize*1024*1024, maxAge))
+	options = append(options, Durable(args["--fsync"].(bool)))
+	options = append(options, OnWriteFailure(args["--on-write-error"].(string)))
+	options = append(options, FailureLog(args["--failure-log"].(bool)))
+
+	if args["--db"] != nil {
+		options = append(options, Database(args["--db"].(string)))
+	}
+
+	if args["--print-flow"] != nil {
+		options = append(options, PrintFlow(args["--print-flow"].(string), os.Stdout))
+	}
+
+	if args["--archive"] != nil {
+		options = append(options, Archive(args["--archive"].(string)))
+	}
+
+	if args["--webhook"] != nil {
+		header := make(http.Header)
+		for _, h := range args["--webhook-header"].([]string) {
+			parts := strings.SplitN(h, ":", 2)
+			if len(parts) != 2 {
+				onErrorExit(errors.Errorf("invalid --webhook-header: %s", h))
+			}
+			header.Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+		}
+		options = append(options, Webhook(args["--webhook"].(string), header))
+	}
+
+	if args["--webhook-spool"] != nil {
+		options = append(options, WebhookSpool(args["--webhook-spool"].(string)))
+	}
+
+	if args["--store"] != nil {
+		options = append(options, Store(args["--store"].(string)))
+	}
 
 	extractor, err = NewExtractor(handle, options...)
 	onErrorExit(err)
 
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 	onInterruptSignal(func() {
 		os.Stdout.WriteString("\n")
-		extractor.Close()
+		cancel()
 	})
 
-	extractor.Run()
+	_, runErr := extractor.Run(ctx)
+	handle.Close()
+	if errors.Is(runErr, context.Canceled) {
+		// interrupted, everything captured has been written
+		runErr = nil
+	}
+	onErrorExit(runErr)
+}
 
-	stats, err := handle.Stats()
-	if err == nil {
-		spew.Dump(*stats)
+// parseStream prints the handshake found in the server side of a connection,
+// read from a file or stdin ("-"), as JSON.
+func parseStream(path string, hexDump bool, peer int) error {
+	var (
+		data []byte
+		err  error
+	)
+	if path == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(path)
 	}
-	handle.Close()
+	if err != nil {
+		return err
+	}
+	if hexDump {
+		if data, err = DecodeHexDumpPeer(data, peer); err != nil {
+			return err
+		}
+	}
+
+	result, err := ParseStream(bytes.NewReader(data), Meta{Source: path})
+	if result != nil {
+		out := struct {
+			Preamble     string         `json:"preamble"`
+			Observation  Observation    `json:"observation"`
+			Certificates []*Certificate `json:"certificates"`
+		}{result.Preamble, result.Observation, []*Certificate{}}
+		for _, cert := range result.Chain {
+			out.Certificates = append(out.Certificates, NewCertificate(cert))
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if jerr := enc.Encode(&out); jerr != nil {
+			return jerr
+		}
+	}
+	return err
 }
 
 func onErrorExit(err error) {
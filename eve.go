@@ -0,0 +1,205 @@
+package certgrep
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	eveTimestampFormat = "2006-01-02T15:04:05.000000-0700"
+	eveValidityFormat  = "2006-01-02T15:04:05"
+	// Suricata's flow ids fit in 51 bits, so that they survive JSON parsers
+	// using doubles
+	eveFlowIDMask = 1<<51 - 1
+)
+
+// eveVersions maps TLS versions to the names used by Suricata.
+var eveVersions = map[uint16]string{
+	0x0300: "SSLv3",
+	0x0301: "TLSv1",
+	0x0302: "TLS 1.1",
+	0x0303: "TLS 1.2",
+	0x0304: "TLS 1.3",
+}
+
+// Short names of distinguished name attributes, as printed by OpenSSL.
+var dnAttributeNames = map[string]string{
+	"2.5.4.3":                    "CN",
+	"2.5.4.5":                    "serialNumber",
+	"2.5.4.6":                    "C",
+	"2.5.4.7":                    "L",
+	"2.5.4.8":                    "ST",
+	"2.5.4.9":                    "street",
+	"2.5.4.10":                   "O",
+	"2.5.4.11":                   "OU",
+	"2.5.4.15":                   "businessCategory",
+	"2.5.4.17":                   "postalCode",
+	"1.2.840.113549.1.9.1":       "emailAddress",
+	"0.9.2342.19200300.100.1.25": "DC",
+	"1.3.6.1.4.1.311.60.2.1.2":   "jurisdictionST",
+	"1.3.6.1.4.1.311.60.2.1.3":   "jurisdictionC",
+}
+
+// eveRecord is a Suricata EVE record with event_type tls.
+type eveRecord struct {
+	Timestamp string `json:"timestamp"`
+	FlowID    uint64 `json:"flow_id"`
+	EventType string `json:"event_type"`
+	SrcIP     string `json:"src_ip"`
+	SrcPort   int    `json:"src_port"`
+	DestIP    string `json:"dest_ip"`
+	DestPort  int    `json:"dest_port"`
+	Proto     string `json:"proto"`
+	TLS       eveTLS `json:"tls"`
+}
+
+type eveTLS struct {
+	Subject     string   `json:"subject"`
+	IssuerDN    string   `json:"issuerdn"`
+	Serial      string   `json:"serial"`
+	Fingerprint string   `json:"fingerprint"`
+	SNI         string   `json:"sni,omitempty"`
+	Version     string   `json:"version,omitempty"`
+	NotBefore   string   `json:"notbefore"`
+	NotAfter    string   `json:"notafter"`
+	JA3         *eveJA3  `json:"ja3,omitempty"`
+	JA3S        *eveJA3  `json:"ja3s,omitempty"`
+	Chain       []string `json:"chain,omitempty"`
+}
+
+type eveJA3 struct {
+	Hash   string `json:"hash"`
+	String string `json:"string"`
+}
+
+func newEveJA3(s string) *eveJA3 {
+	if s == "" {
+		return nil
+	}
+	return &eveJA3{Hash: ja3Hash(s), String: s}
+}
+
+// eveWriter writes a Suricata EVE tls record per chain to eve.json, so that
+// certgrep's results can be fed to tooling built around Suricata.
+type eveWriter struct {
+	f     *os.File
+	w     *bufio.Writer
+	enc   *json.Encoder
+	chain bool
+	// sync on flush
+	durable bool
+}
+
+func newEveWriter(fs fileSystem, dir string, chain, durable bool) (*eveWriter, error) {
+	f, err := createFile(fs, filepath.Join(dir, "eve.json"))
+	if err != nil {
+		return nil, err
+	}
+	w := bufio.NewWriter(f)
+	return &eveWriter{f: f, w: w, enc: json.NewEncoder(w), chain: chain, durable: durable}, nil
+}
+
+func (w *eveWriter) Observe(_ context.Context, obs Observation) error {
+	if len(obs.Chain) == 0 {
+		return nil
+	}
+	leaf := obs.Chain[0]
+
+	clientIP, clientPort := splitHostPort(obs.Client)
+	serverIP, serverPort := splitHostPort(obs.Server)
+	fingerprint := sha1.Sum(leaf.Raw)
+
+	rec := eveRecord{
+		Timestamp: obs.seen().UTC().Format(eveTimestampFormat),
+		FlowID:    binary.BigEndian.Uint64(obs.connectionID()) & eveFlowIDMask,
+		EventType: "tls",
+		SrcIP:     clientIP,
+		SrcPort:   clientPort,
+		DestIP:    serverIP,
+		DestPort:  serverPort,
+		Proto:     "TCP",
+		TLS: eveTLS{
+			Subject:     opensslDN(leaf.Subject),
+			IssuerDN:    opensslDN(leaf.Issuer),
+			Serial:      colonHex(integerBytes(leaf.SerialNumber), true),
+			Fingerprint: colonHex(fingerprint[:], false),
+			SNI:         obs.ServerName,
+			Version:     eveVersions[obs.Version],
+			NotBefore:   leaf.NotBefore.UTC().Format(eveValidityFormat),
+			NotAfter:    leaf.NotAfter.UTC().Format(eveValidityFormat),
+			JA3:         newEveJA3(obs.JA3),
+			JA3S:        newEveJA3(obs.JA3S),
+		},
+	}
+	if w.chain {
+		for _, cert := range obs.Chain {
+			rec.TLS.Chain = append(rec.TLS.Chain, base64.StdEncoding.EncodeToString(cert.Raw))
+		}
+	}
+	return w.enc.Encode(&rec)
+}
+
+func (w *eveWriter) flush() error {
+	if err := w.w.Flush(); err != nil || !w.durable {
+		return err
+	}
+	return w.f.Sync()
+}
+
+func (w *eveWriter) Close() error {
+	err := w.flush()
+	if cerr := w.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// opensslDN formats a distinguished name the way Suricata does, attributes in
+// certificate order separated by ", ".
+func opensslDN(name pkix.Name) string {
+	parts := make([]string, 0, len(name.Names))
+	for _, atv := range name.Names {
+		parts = append(parts, fmt.Sprintf("%s=%v", dnAttributeName(atv.Type), atv.Value))
+	}
+	return strings.Join(parts, ", ")
+}
+
+func dnAttributeName(oid asn1.ObjectIdentifier) string {
+	if name, ok := dnAttributeNames[oid.String()]; ok {
+		return name
+	}
+	return oid.String()
+}
+
+// integerBytes returns the big endian bytes of a positive ASN.1 INTEGER as
+// encoded in a certificate, with a leading zero byte if the high bit is set.
+func integerBytes(n *big.Int) []byte {
+	b := n.Bytes()
+	if len(b) == 0 || b[0]&0x80 != 0 {
+		b = append([]byte{0}, b...)
+	}
+	return b
+}
+
+// colonHex formats b as colon separated hex bytes.
+func colonHex(b []byte, upper bool) string {
+	parts := make([]string, len(b))
+	for i, c := range b {
+		parts[i] = fmt.Sprintf("%02x", c)
+		if upper {
+			parts[i] = strings.ToUpper(parts[i])
+		}
+	}
+	return strings.Join(parts, ":")
+}
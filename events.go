@@ -0,0 +1,145 @@
+package certgrep
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"time"
+)
+
+// EventSchemaVersion is the version of the JSON Lines event schema, see
+// schema/events.schema.json. The minor version is bumped when fields are
+// added, the major version when fields are removed or change meaning.
+const EventSchemaVersion = "1.0"
+
+const (
+	eventSession     = "session"
+	eventCertificate = "certificate"
+)
+
+type eventEndpoint struct {
+	IP   string `json:"ip"`
+	Port int    `json:"port"`
+}
+
+func newEventEndpoint(hostport string) eventEndpoint {
+	ip, port := splitHostPort(hostport)
+	return eventEndpoint{IP: ip, Port: port}
+}
+
+// eventHeader is shared by all events.
+type eventHeader struct {
+	SchemaVersion string        `json:"schema_version"`
+	Event         string        `json:"event"`
+	Time          time.Time     `json:"time"`
+	FlowIndex     uint64        `json:"flow_index"`
+	FlowHash      string        `json:"flow_hash"`
+	Server        eventEndpoint `json:"server"`
+	Client        eventEndpoint `json:"client"`
+	ServerName    string        `json:"server_name,omitempty"`
+	ChainHash     string        `json:"chain_hash"`
+}
+
+// sessionEvent is written once per TLS handshake a chain was extracted from.
+type sessionEvent struct {
+	eventHeader
+	Version           string     `json:"version,omitempty"`
+	CipherSuite       string     `json:"cipher_suite,omitempty"`
+	ConnectionStart   *time.Time `json:"connection_start,omitempty"`
+	CertificateSeen   *time.Time `json:"certificate_seen,omitempty"`
+	HandshakeComplete *time.Time `json:"handshake_complete,omitempty"`
+	Processed         time.Time  `json:"processed"`
+	Source            string     `json:"source,omitempty"`
+	Chain             []string   `json:"chain"`
+}
+
+// certificateEvent is written for every certificate of a chain.
+type certificateEvent struct {
+	eventHeader
+	Position  int       `json:"position"`
+	SHA1      string    `json:"sha1"`
+	SHA256    string    `json:"sha256"`
+	Serial    string    `json:"serial"`
+	Subject   string    `json:"subject"`
+	SubjectCN string    `json:"subject_cn"`
+	Issuer    string    `json:"issuer"`
+	IssuerCN  string    `json:"issuer_cn"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+	DNSNames  []string  `json:"dns_names"`
+	IsCA      bool      `json:"is_ca"`
+}
+
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	t = t.UTC()
+	return &t
+}
+
+// writeEvents writes the session event of a chain followed by one event per
+// certificate, one JSON document per line.
+func writeEvents(w io.Writer, obs Observation) error {
+	header := eventHeader{
+		SchemaVersion: EventSchemaVersion,
+		Time:          obs.seen().UTC(),
+		FlowIndex:     obs.FlowIndex,
+		FlowHash:      obs.FlowHash,
+		Server:        newEventEndpoint(obs.Server),
+		Client:        newEventEndpoint(obs.Client),
+		ServerName:    obs.ServerName,
+		ChainHash:     chainHash(obs.Chain),
+	}
+
+	enc := json.NewEncoder(w)
+
+	session := sessionEvent{
+		eventHeader:       header,
+		Version:           versionName(obs.Version),
+		CipherSuite:       cipherSuiteName(obs.CipherSuite),
+		ConnectionStart:   optionalTime(obs.ConnectionStart),
+		CertificateSeen:   optionalTime(obs.CertificateSeen),
+		HandshakeComplete: optionalTime(obs.HandshakeComplete),
+		Processed:         obs.Processed.UTC(),
+		Source:            obs.Source,
+		Chain:             make([]string, 0, len(obs.Chain)),
+	}
+	session.Event = eventSession
+	for _, cert := range obs.Chain {
+		sum := sha256.Sum256(cert.Raw)
+		session.Chain = append(session.Chain, hex.EncodeToString(sum[:]))
+	}
+	if err := enc.Encode(&session); err != nil {
+		return err
+	}
+
+	for i, cert := range obs.Chain {
+		sum1 := sha1.Sum(cert.Raw)
+		event := certificateEvent{
+			eventHeader: header,
+			Position:    i,
+			SHA1:        hex.EncodeToString(sum1[:]),
+			SHA256:      session.Chain[i],
+			Serial:      cert.SerialNumber.String(),
+			Subject:     cert.Subject.String(),
+			SubjectCN:   cert.Subject.CommonName,
+			Issuer:      cert.Issuer.String(),
+			IssuerCN:    cert.Issuer.CommonName,
+			NotBefore:   cert.NotBefore.UTC(),
+			NotAfter:    cert.NotAfter.UTC(),
+			DNSNames:    cert.DNSNames,
+			IsCA:        cert.IsCA,
+		}
+		event.Event = eventCertificate
+		if event.DNSNames == nil {
+			event.DNSNames = []string{}
+		}
+		if err := enc.Encode(&event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
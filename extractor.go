@@ -1,22 +1,21 @@
 package certgrep
 
 import (
+	"context"
 	"encoding/hex"
 	"fmt"
 	"io"
+	"net"
 	"os"
-	"os/user"
-	"runtime"
+	"path/filepath"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcap"
 	"github.com/google/gopacket/tcpassembly"
 	"github.com/mgutz/ansi"
-	"github.com/olekukonko/tablewriter"
 	"go.uber.org/zap"
 )
 
@@ -33,21 +32,40 @@ var (
 )
 
 type Extractor struct {
-	handle        *pcap.Handle
+	packets       PacketSource
 	logger        *zap.SugaredLogger
 	verbose       bool
 	bpf           string
 	outputOptions outputOptions
 	close         chan struct{}
 	closeOnce     sync.Once
-	logToStdout   bool
+	mu            sync.Mutex
+	running       bool
+	// closed when Run has returned
+	finished    chan struct{}
+	logToStdout bool
+	prefilter   bool
+	source      string
+	handshake   *handshakeConfig
+	// where run directories are created, see OutputDir
+	outputDir string
 }
 
-func NewExtractor(handle *pcap.Handle, options ...Option) (*Extractor, error) {
+// NewExtractor returns an Extractor reading packets from source.
+func NewExtractor(source PacketSource, options ...Option) (*Extractor, error) {
 	e := &Extractor{
-		handle: handle,
-		close:  make(chan struct{}),
+		packets:   source,
+		logger:    zap.NewNop().Sugar(),
+		close:     make(chan struct{}),
+		finished:  make(chan struct{}),
+		prefilter: true,
+		handshake: newHandshakeConfig(),
 	}
+	e.outputOptions.logFormat = logFormatText
+	e.outputOptions.onWriteFailure = WriteFailureAbort
+	e.outputOptions.parquetMaxSize = defaultParquetMaxSize
+	e.outputOptions.parquetMaxAge = defaultParquetMaxAge
+	e.outputOptions.now = time.Now
 
 	for _, option := range options {
 		err := option(e)
@@ -59,101 +77,203 @@ func NewExtractor(handle *pcap.Handle, options ...Option) (*Extractor, error) {
 	return e, nil
 }
 
+// Close stops the capture. If Run is running, Close waits for it to write
+// out everything captured so far and finalise the output.
 func (e *Extractor) Close() {
 	e.closeOnce.Do(func() {
 		close(e.close)
 	})
+	e.mu.Lock()
+	running := e.running
+	e.mu.Unlock()
+	if running {
+		<-e.finished
+	}
 }
 
-func (e *Extractor) Run() (err error) {
-	packetSource := gopacket.NewPacketSource(e.handle, e.handle.LinkType())
+// Run reads packets until the source is exhausted, ctx is cancelled or Close
+// is called, and writes out everything extracted before returning. Errors
+// reading packets, setting the capture filter or writing the output are
+// returned, along with what was processed up to them. A write failing under
+// WriteFailureAbort stops the run right away. If ctx was cancelled, and
+// nothing failed, the error is ctx.Err(); stopping with Close isn't an error.
+// An Extractor runs once.
+func (e *Extractor) Run(ctx context.Context) (summary Summary, err error) {
+	e.mu.Lock()
+	if e.running {
+		e.mu.Unlock()
+		return summary, fmt.Errorf("the extractor has already run")
+	}
+	e.running = true
+	e.mu.Unlock()
+	defer close(e.finished)
+	start := time.Now()
+
+	if e.bpf != "" {
+		fs, ok := e.packets.(FilterSource)
+		if !ok {
+			return summary, fmt.Errorf("the packet source doesn't support capture filters")
+		}
+		if err = fs.SetBPFFilter(e.bpf); err != nil {
+			return summary, fmt.Errorf("setting capture filter: %w", err)
+		}
+	}
+
+	packetSource := gopacket.NewPacketSource(e.packets, e.packets.LinkType())
+	// only the layers up to TCP are needed, and only for packets that make
+	// it past the flow table
+	packetSource.DecodeOptions = gopacket.DecodeOptions{Lazy: true, NoCopy: true}
+	stop := make(chan struct{})
+	defer close(stop)
+	packets, readErr := readPackets(packetSource, stop)
+
+	// the run directory is named after the first packet
+	var first gopacket.Packet
+	select {
+	case first = <-packets:
+	case <-e.close:
+	case <-ctx.Done():
+	}
+	if e.outputDir != "" {
+		started := start
+		if first != nil {
+			started = first.Metadata().Timestamp
+		}
+		e.outputOptions.dir = runDir(e.outputDir, started, e.outputOptions.archive)
+	}
+
 	logFile := "extractor.log"
+	if e.outputOptions.logFormat == logFormatJSONL {
+		logFile = "events.jsonl"
+	}
 	if e.logToStdout {
-		logLine = "-"
+		logFile = "-"
 	}
-	output, err := newOutput(logFile, e.outputOptions)
+	output, err := newOutput(logFile, e.outputOptions, e.logger.Named("output"))
 	if err != nil {
-		return err
+		return summary, err
 	}
-	pool := tcpassembly.NewStreamPool(&readerFactory{
-		logger: e.logger.Named("reader"),
-		output: output,
-	})
+	// chains in flight are still written once ctx is cancelled
+	output.ctx = detachedContext{ctx}
+	var failuresMu sync.Mutex
+	factory := NewStreamFactory(output, e.logger.Named("reader"),
+		FactorySource(e.source), FactoryPrefilter(e.prefilter),
+		OnFlowResult(func(result FlowResult) {
+			if result.Err == nil || len(result.Chain) > 0 || result.Err == ErrClientSide {
+				return
+			}
+			failuresMu.Lock()
+			summary.Failures.add(result.Err)
+			failuresMu.Unlock()
+			output.logFailure(result)
+		}))
+	factory.handshake = e.handshake
+	factory.now = e.outputOptions.now
+	flows := factory.flows
+	pool := tcpassembly.NewStreamPool(factory)
 	assembler := tcpassembly.NewAssembler(pool)
-	packets := packetSource.Packets()
-	ticker := time.Tick(maxAge)
+	ticker := time.NewTicker(maxAge)
+	defer ticker.Stop()
 
-	e.logger.Infof("setting output dir to: %s", e.outputOptions.dir)
+	if e.outputOptions.usesDir(e.logToStdout) {
+		if e.outputOptions.archive != "" {
+			e.logger.Infof("writing archive: %s", e.outputOptions.archivePath())
+		} else {
+			e.logger.Infof("setting output dir to: %s", e.outputOptions.dir)
+		}
+	}
+	if e.outputOptions.store != "" {
+		e.logger.Infof("using certificate store: %s", e.outputOptions.store)
+	}
 
 	var (
-		lastFlush   time.Time
-		firstPacket time.Time
-		current     time.Time
-		processed   int64
-		c           int64
+		lastFlush time.Time
+		current   time.Time
+		// wall clock time the current packet was read
+		currentRead time.Time
+		cancelled   bool
 	)
 
-	start := time.Now()
-
 	for {
-		select {
-		case <-e.close:
-			goto done
-		case packet := <-packets:
-			// A nil packet indicates the end of a pcap file.
-			if packet == nil {
-				// TODO: find a better way to let flow workers finish
-				time.Sleep(500 * time.Millisecond)
+		packet := first
+		first = nil
+		if packet == nil {
+			select {
+			case <-e.close:
+				goto done
+			case <-ctx.Done():
+				cancelled = true
+				goto done
+			case werr := <-output.aborted:
+				err = fmt.Errorf("writing output: %w", werr)
+				goto done
+			case packet = <-packets:
+			case <-ticker.C:
+				// Packet timestamps are the reference, wall clock time only
+				// accounts for the time spent waiting since the last packet. For
+				// a pcap file this doesn't flush anything the packet driven flush
+				// below wouldn't, which keeps the results reproducible.
+				if !current.IsZero() {
+					cutoff := current.Add(time.Since(currentRead)).Add(-1 * maxAge)
+					assembler.FlushOlderThan(cutoff)
+					factory.FlushOlderThan(cutoff)
+				}
+				/*
+					if Config.metrics {
+						grGauge.Update(int64(runtime.NumGoroutine()))
+						flushedCount.Mark(int64(flushed))
+						doFlush.Mark(1)
+					}
+				*/
+				continue
+			}
+		}
+
+		// the end of the capture, or a failure reading it
+		if packet == nil {
+			if err = <-readErr; err != nil {
+				err = fmt.Errorf("reading packets: %w", err)
+			} else {
 				//if Config.verbose {
 				e.logger.Debugf("last packet, goodbye.")
 				//}
-				output.WaitUntilDone()
-				goto done
 			}
+			goto done
+		}
 
-			current = packet.Metadata().Timestamp
-			processed += int64(len(packet.Data()))
-			c++ // go is better
+		current = packet.Metadata().Timestamp
+		currentRead = time.Now()
+		summary.Bytes += int64(len(packet.Data()))
+		summary.Packets++
 
-			// first packet
-			if lastFlush.IsZero() {
-				lastFlush = current
-				firstPacket = current
-			}
+		// first packet
+		if lastFlush.IsZero() {
+			lastFlush = current
+			summary.FirstPacket = current
+		}
 
-			if err := packet.ErrorLayer(); err != nil {
-				//fmt.Println(err)
-			} else {
-				if netLayer := packet.NetworkLayer(); netLayer != nil {
-					flow := netLayer.NetworkFlow()
-					if tcpLayer := packet.Layer(layers.LayerTypeTCP); tcpLayer != nil {
-						tcp, _ := tcpLayer.(*layers.TCP)
-						if dumpPackets {
-							e.logger.Debugf("%s\n%s", flow.String(), phosphorize(hex.Dump(tcpLayer.LayerPayload())))
-						}
-						assembler.AssembleWithTimestamp(flow, tcp, current)
-						/*
-							if Config.metrics {
-								packetCount.Mark(1)
-							}
-						*/
+		// Note: ErrorLayer() would force a lazy packet to be fully decoded
+		if tcp, ok := packet.Layer(layers.LayerTypeTCP).(*layers.TCP); ok {
+			if netLayer := packet.NetworkLayer(); netLayer != nil {
+				flow := netLayer.NetworkFlow()
+				if factory.Admit(flow, tcp, len(packet.Data()), current) {
+					if dumpPackets {
+						e.logger.Debugf("%s\n%s", flow.String(), phosphorize(hex.Dump(tcp.LayerPayload())))
 					}
+					assembler.AssembleWithTimestamp(flow, tcp, current)
 				}
-			}
-
-			if current.Sub(lastFlush) > maxAge {
-				assembler.FlushOlderThan(lastFlush)
-				lastFlush = current
 				/*
 					if Config.metrics {
-						grGauge.Update(int64(runtime.NumGoroutine()))
-						flushedCount.Mark(int64(flushed))
-						doFlush.Mark(1)
+						packetCount.Mark(1)
 					}
 				*/
 			}
-		case <-ticker:
-			assembler.FlushOlderThan(time.Now().Add(-1 * maxAge))
+		}
+
+		if current.Sub(lastFlush) > maxAge {
+			assembler.FlushOlderThan(lastFlush)
+			factory.FlushOlderThan(lastFlush)
+			lastFlush = current
 			/*
 				if Config.metrics {
 					grGauge.Update(int64(runtime.NumGoroutine()))
@@ -165,57 +285,95 @@ func (e *Extractor) Run() (err error) {
 	}
 
 done:
-	e.logger.Infof("capture time: %.f seconds", current.Sub(firstPacket).Seconds())
-	e.logger.Infof("capture size: %d bytes", processed)
+	// Hand everything still buffered to the stream handlers, wait for all of
+	// them to finish and only then drain the output.
+	flushed := assembler.FlushAll()
+	e.logger.Debugf("flushed %d connections", flushed)
+	factory.Wait()
+	writeErr := output.Close()
 
-	bps := 8 * (float64(processed) / current.Sub(firstPacket).Seconds())
-	if bps < 1024*1024 {
-		e.logger.Infof("average capture rate: %.3f Kbit/s", bps/1024)
-	} else if bps < 1024*1024*1024 {
-		e.logger.Infof("average capture rate: %.3f Mbit/s", bps/(1024*1024))
-	} else {
-		e.logger.Infof("average capture rate: %.3f Gbit/s", bps/(1024*1024*1024))
+	summary.LastPacket = current
+	summary.Elapsed = time.Since(start)
+	summary.SkippedBytes, summary.SkippedPackets = flows.skipped()
+	summary.RejectedFlows = flows.rejected()
+	summary.Chains = output.chains
+	summary.SkippedWrites = output.failures
+	if s, ok := e.packets.(StatsSource); ok {
+		if stats, serr := s.Stats(); serr == nil {
+			summary.Capture = &stats
+		}
 	}
-	e.logger.Infof("pps: %.f", float64(c)/time.Now().Sub(start).Seconds())
+	summary.log(e.logger, e.prefilter)
 
-	return
+	if writeErr != nil && err == nil {
+		err = fmt.Errorf("writing output: %w", writeErr)
+	}
+	if cancelled && err == nil {
+		err = ctx.Err()
+	}
+	return summary, err
 }
 
-func PrintDeviceTable(out io.Writer, logger *zap.SugaredLogger) error {
-	if runtime.GOOS == "linux" {
-		if os.Geteuid() != 0 {
-			logger.Info("Not all capture devices may be visible with your current user.")
+// readPackets reads packets until the source is exhausted, fails or stop is
+// closed. After the last packet the channel is closed, and the error ending
+// the source, nil at its end, is sent to the error channel.
+func readPackets(source *gopacket.PacketSource, stop <-chan struct{}) (<-chan gopacket.Packet, <-chan error) {
+	packets := make(chan gopacket.Packet, 1000)
+	errc := make(chan error, 1)
+	go func() {
+		for {
+			packet, err := source.NextPacket()
+			if err == nil {
+				select {
+				case packets <- packet:
+					continue
+				case <-stop:
+					return
+				}
+			}
+			if nerr, ok := err.(net.Error); ok && nerr.Temporary() {
+				continue
+			}
+			if err == io.EOF {
+				err = nil
+			}
+			// after the packets read so far
+			errc <- err
+			close(packets)
+			return
 		}
-	}
+	}()
+	return packets, errc
+}
 
-	ifs, err := pcap.FindAllDevs()
-	if err != nil {
-		return err
-	}
+// detachedContext carries the values of a context, but not its cancellation.
+type detachedContext struct {
+	parent context.Context
+}
 
-	if len(ifs) == 0 {
-		me, _ := user.Current()
-		return fmt.Errorf("No devices found. Does user \"%s\" have access?", me.Name)
-	}
-	tbl := tablewriter.NewWriter(out)
-	tbl.SetHeader([]string{"name", "addresses", "description"})
-	tbl.SetRowLine(true)
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
 
-	for _, dev := range ifs {
-		var addresses []string
+func (c detachedContext) Value(key interface{}) interface{} {
+	return c.parent.Value(key)
+}
 
-		for _, a := range dev.Addresses {
-			addresses = append(addresses, a.IP.String())
+// runDir returns the directory of a run in parent, named after the capture
+// time of its first packet. Directories, or archives standing in for them,
+// of earlier runs over the same capture are left alone: the name gets a .1,
+// .2, ... suffix.
+func runDir(parent string, first time.Time, archive string) string {
+	name := strings.Replace(first.UTC().Format(time.RFC3339), ":", "_", -1)
+	dir := filepath.Join(parent, name)
+	for i := 1; ; i++ {
+		_, err := os.Lstat(dir)
+		if os.IsNotExist(err) && archive != "" {
+			_, err = os.Lstat(dir + "." + archive)
 		}
-
-		tbl.Append([]string{
-			dev.Name,
-			strings.Join(addresses, "\n"),
-			dev.Description,
-		})
+		if os.IsNotExist(err) {
+			return dir
+		}
+		dir = filepath.Join(parent, fmt.Sprintf("%s.%d", name, i))
 	}
-
-	tbl.Render()
-
-	return nil
 }
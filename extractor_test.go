@@ -0,0 +1,164 @@
+package certgrep
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/pcapgo"
+)
+
+// every format, with the wall clock pinned by processedAt their output only
+// depends on the capture. sqlite_test.go adds sqlite where cgo is available.
+var deterministicFormats = []string{
+	"der", "pem", "text", "json", "chain", "zeek", "zeek-json", "eve", "parquet", "stix",
+}
+
+// processedAt pins the wall clock, which the processing times and Zeek's
+// #open and #close come from.
+func processedAt(now time.Time) Option {
+	return func(e *Extractor) error {
+		e.outputOptions.now = func() time.Time { return now }
+		return nil
+	}
+}
+
+// extract runs an Extractor over a capture file, writing the deterministic
+// formats and those of options, and returns the directory of the run.
+func extract(t *testing.T, capture string, options ...Option) (string, Summary) {
+	t.Helper()
+	f, err := os.Open(capture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	source, err := pcapgo.NewNgReader(f, pcapgo.DefaultNgReaderOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	options = append(options, OutputDir(dir), CaptureSource(filepath.Base(capture)),
+		processedAt(time.Date(2020, 2, 1, 0, 0, 0, 0, time.UTC)))
+	for _, format := range deterministicFormats {
+		options = append(options, EnableOutputFormat(format, true))
+	}
+	e, err := NewExtractor(source, options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	summary, err := e.Run(context.Background())
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+
+	runs, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 1 {
+		t.Fatalf("%d run directories, want 1", len(runs))
+	}
+	return filepath.Join(dir, runs[0].Name()), summary
+}
+
+// readTree returns the files below dir by their relative path. Symlinks are
+// returned as "-> target".
+func readTree(t *testing.T, dir string) map[string][]byte {
+	t.Helper()
+	files := map[string][]byte{}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Readlink(path)
+			files[rel] = []byte("-> " + target)
+			return err
+		}
+		files[rel], err = ioutil.ReadFile(path)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestExtractorDeterministic(t *testing.T) {
+	captures, err := filepath.Glob("testdata/*.pcap*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(captures) == 0 {
+		t.Fatal("no captures in testdata")
+	}
+	for _, capture := range captures {
+		t.Run(filepath.Base(capture), func(t *testing.T) {
+			first, summary := extract(t, capture)
+			if summary.Chains == 0 {
+				t.Fatalf("no chains extracted: %+v", summary)
+			}
+			second, _ := extract(t, capture)
+
+			a, b := readTree(t, first), readTree(t, second)
+			var names []string
+			for name := range a {
+				names = append(names, name)
+				if _, ok := b[name]; !ok {
+					t.Errorf("%s missing from the second run", name)
+				}
+			}
+			for name := range b {
+				if _, ok := a[name]; !ok {
+					t.Errorf("%s missing from the first run", name)
+				}
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				if b[name] != nil && !bytes.Equal(a[name], b[name]) {
+					t.Errorf("%s differs between runs", name)
+				}
+			}
+			want := []string{"extractor.log", "eve.json", "ssl.log", "ssl.json", "x509.json",
+				"observations-0001.parquet", "stix-0001.json"}
+			if containsString(deterministicFormats, "sqlite") {
+				want = append(want, "certgrep.db")
+			}
+			for _, name := range want {
+				if len(a[name]) == 0 {
+					t.Errorf("%s is missing or empty", name)
+				}
+			}
+			// cert.json is the certificate model only, nothing of the
+			// connection it was seen in
+			for name, der := range a {
+				if filepath.Base(name) != "cert.der" {
+					continue
+				}
+				cert, err := x509.ParseCertificate(der)
+				if err != nil {
+					t.Fatal(err)
+				}
+				want, err := json.MarshalIndent(NewCertificate(cert), "", "  ")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := a[filepath.Join(filepath.Dir(name), "cert.json")]; !bytes.Equal(got, want) {
+					t.Errorf("cert.json next to %s is not the certificate model", name)
+				}
+			}
+		})
+	}
+}
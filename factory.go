@@ -0,0 +1,155 @@
+package certgrep
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/tcpassembly"
+	"go.uber.org/zap"
+)
+
+// FlowResult is the outcome of a stream: where it was seen and, if the
+// server sent one, the chain. Err is nil if the chain was handed to the sink,
+// the error of ParseStream or of the sink otherwise.
+type FlowResult struct {
+	Observation
+	Err error
+}
+
+// StreamFactory is a tcpassembly.StreamFactory extracting certificate chains
+// from the streams of an assembler, and handing them to a sink. It can be
+// added to an assembler running other protocols as well, through a
+// tcpassembly.StreamFactory dispatching on the port or on the first bytes
+// of a stream. Extractor.Run is a packet loop around it.
+//
+// Packets offered to Admit before they are assembled give the chains the
+// SNI and JA3 of the client hello, and let the factory drop what's left of
+// connections it is done with. FlushOlderThan must be called along with the
+// assembler's to expire what it keeps track of.
+type StreamFactory struct {
+	// numbers the streams, first for 64 bit alignment
+	flowIdx uint64
+
+	sink      Sink
+	logger    *zap.SugaredLogger
+	source    string
+	onResult  func(FlowResult)
+	ctx       context.Context
+	flows     *flowTable
+	handshake *handshakeConfig
+	// the wall clock, for the observations' Processed
+	now func() time.Time
+
+	// serialises calls to the sink
+	mu sync.Mutex
+	wg sync.WaitGroup
+}
+
+// StreamFactoryOption configures a StreamFactory.
+type StreamFactoryOption func(*StreamFactory)
+
+// FactorySource sets the Source of the observations, e.g. the capture file
+// or interface.
+func FactorySource(source string) StreamFactoryOption {
+	return func(f *StreamFactory) {
+		f.source = source
+	}
+}
+
+// FactoryPrefilter enables classification of flows by Admit, see Prefilter.
+// Only useful if Admit decides which packets are assembled.
+func FactoryPrefilter(do bool) StreamFactoryOption {
+	return func(f *StreamFactory) {
+		f.flows.classify = do
+	}
+}
+
+// FactoryContext sets the context passed to the sink.
+func FactoryContext(ctx context.Context) StreamFactoryOption {
+	return func(f *StreamFactory) {
+		f.ctx = ctx
+	}
+}
+
+// OnFlowResult registers a function called with the outcome of every stream,
+// from the goroutine reading the stream.
+func OnFlowResult(fn func(FlowResult)) StreamFactoryOption {
+	return func(f *StreamFactory) {
+		f.onResult = fn
+	}
+}
+
+// NewStreamFactory returns a factory handing the chains it finds to sink.
+// Observe is never called concurrently, the factory doesn't close the sink.
+// A nil logger discards the debug messages.
+func NewStreamFactory(sink Sink, logger *zap.SugaredLogger, options ...StreamFactoryOption) *StreamFactory {
+	if logger == nil {
+		logger = zap.NewNop().Sugar()
+	}
+	f := &StreamFactory{
+		sink:      sink,
+		logger:    logger,
+		ctx:       context.Background(),
+		flows:     newFlowTable(false),
+		handshake: newHandshakeConfig(),
+		now:       time.Now,
+	}
+	for _, option := range options {
+		option(f)
+	}
+	return f
+}
+
+// New implements tcpassembly.StreamFactory. Every stream is read by a
+// goroutine of its own.
+func (f *StreamFactory) New(netflow gopacket.Flow, tcpflow gopacket.Flow) tcpassembly.Stream {
+	r := newTimedStream()
+	h := newStreamHandler(r, netflow, tcpflow, f, f.flows, f.logger.Named("stream"))
+	h.source = f.source
+
+	f.wg.Add(1)
+	go func() {
+		defer f.wg.Done()
+		// TODO: this should go someplace else...
+		defer r.Close()
+		err := h.Run()
+		if err != nil {
+			//log.Println(err)
+		}
+	}()
+
+	return r
+}
+
+// Admit records a packet before it is assembled, and reports whether it can
+// still be of use to the factory. Packets of directions the factory is done
+// with, or rejected by the prefilter, needn't be assembled for it.
+func (f *StreamFactory) Admit(netflow gopacket.Flow, tcp *layers.TCP, size int, seen time.Time) bool {
+	return f.flows.admit(netflow, tcp, size, seen)
+}
+
+// FlushOlderThan forgets connections without packets since t.
+func (f *StreamFactory) FlushOlderThan(t time.Time) {
+	f.flows.expire(t)
+}
+
+// Wait blocks until every stream handler started by the factory has returned.
+// The assembler must have been flushed.
+func (f *StreamFactory) Wait() {
+	f.wg.Wait()
+}
+
+func (f *StreamFactory) observe(obs Observation) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.sink.Observe(f.ctx, obs)
+}
+
+func (f *StreamFactory) report(result FlowResult) {
+	if f.onResult != nil {
+		f.onResult(result)
+	}
+}
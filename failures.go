@@ -0,0 +1,89 @@
+package certgrep
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// Reasons in the failure log.
+const (
+	failureNotTLS    = "not_tls"
+	failureTruncated = "truncated"
+	failureTLS13     = "tls13_encrypted"
+	failureResumed   = "resumed_session"
+	failureNoCert    = "no_certificate"
+	failureParserBug = "parser_bug"
+	failureOther     = "other"
+)
+
+// failureKind names the reason of the error of a stream no chain was
+// extracted from.
+func failureKind(err error) string {
+	switch {
+	case errors.Is(err, ErrNoTLSHandshakeFound):
+		return failureNotTLS
+	case errors.Is(err, ErrTruncated):
+		return failureTruncated
+	case errors.Is(err, ErrTLS13Encrypted):
+		return failureTLS13
+	case errors.Is(err, ErrResumedSession):
+		return failureResumed
+	case errors.Is(err, ErrNoServerCertificate):
+		return failureNoCert
+	case errors.Is(err, ErrParserBug):
+		return failureParserBug
+	}
+	return failureOther
+}
+
+// failureRecord is a line of failures.jsonl.
+type failureRecord struct {
+	Observation
+	Reason string `json:"reason"`
+	Error  string `json:"error"`
+}
+
+// failureLog writes a JSON line per stream no chain was extracted from to
+// failures.jsonl, see FailureLog.
+type failureLog struct {
+	f   *os.File
+	w   *bufio.Writer
+	enc *json.Encoder
+	// sync on flush
+	durable bool
+}
+
+func newFailureLog(fs fileSystem, dir string, durable bool) (*failureLog, error) {
+	f, err := createFile(fs, filepath.Join(dir, "failures.jsonl"))
+	if err != nil {
+		return nil, err
+	}
+	w := bufio.NewWriter(f)
+	return &failureLog{f: f, w: w, enc: json.NewEncoder(w), durable: durable}, nil
+}
+
+func (l *failureLog) write(result FlowResult) error {
+	return l.enc.Encode(failureRecord{
+		Observation: result.Observation,
+		Reason:      failureKind(result.Err),
+		Error:       result.Err.Error(),
+	})
+}
+
+func (l *failureLog) flush() error {
+	if err := l.w.Flush(); err != nil || !l.durable {
+		return err
+	}
+	return l.f.Sync()
+}
+
+func (l *failureLog) close() error {
+	err := l.flush()
+	if cerr := l.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
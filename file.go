@@ -0,0 +1,118 @@
+package certgrep
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// writeFile writes data to path atomically, through a temporary file in the
+// same directory renamed into place: readers see the previous file or the
+// complete new one, never a partial write. With durable set, the file and
+// its directory are synced before returning.
+func writeFile(path string, data []byte, perm os.FileMode, durable bool) (err error) {
+	dir, name := filepath.Split(path)
+	tmp, err := ioutil.TempFile(dir, "."+name+".tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	if _, err = tmp.Write(data); err != nil {
+		return err
+	}
+	if durable {
+		if err = tmp.Sync(); err != nil {
+			return err
+		}
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	if durable {
+		return syncDir(dir)
+	}
+	return nil
+}
+
+// syncDir makes a rename or a new file in dir durable. Windows can't open
+// directories for syncing, its metadata updates are journaled instead.
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// fileSystem is where the output goes: the output directory, or an archive
+// standing in for it. Paths are file system paths in both cases.
+type fileSystem interface {
+	mkdirAll(dir string) error
+	// writeFile writes a complete file, atomically
+	writeFile(path string, data []byte, perm os.FileMode) error
+	symlink(target, path string) error
+	exists(path string) bool
+	// local returns where a file written to over the whole run, like a log,
+	// lives on disk until the output is closed
+	local(path string) (string, error)
+	close() error
+}
+
+// createFile creates a file written to over the whole run.
+func createFile(fs fileSystem, path string) (*os.File, error) {
+	local, err := fs.local(path)
+	if err != nil {
+		return nil, err
+	}
+	return os.Create(local)
+}
+
+// diskFS writes to the output directory as is.
+type diskFS struct {
+	durable bool
+}
+
+func (fs diskFS) mkdirAll(dir string) error {
+	return os.MkdirAll(dir, defaultDirPerm)
+}
+
+func (fs diskFS) writeFile(path string, data []byte, perm os.FileMode) error {
+	return writeFile(path, data, perm, fs.durable)
+}
+
+func (fs diskFS) symlink(target, path string) error {
+	return os.Symlink(target, path)
+}
+
+func (fs diskFS) exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func (fs diskFS) local(path string) (string, error) {
+	return path, nil
+}
+
+func (fs diskFS) close() error {
+	return nil
+}
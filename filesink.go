@@ -0,0 +1,145 @@
+package certgrep
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"path/filepath"
+)
+
+// fileSink writes the per certificate files, DER, PEM, text and JSON, to the
+// output directory or the certificate store, and records sightings in the
+// store.
+type fileSink struct {
+	*writePolicy
+	options outputOptions
+	fs      fileSystem
+	store   *store
+	// sha256 to the directory certificate files were written to this run
+	canonical map[string]string
+	// links created this run
+	linked map[string]bool
+}
+
+func newFileSink(options outputOptions, fs fileSystem, store *store, policy *writePolicy) *fileSink {
+	return &fileSink{
+		writePolicy: policy,
+		options:     options,
+		fs:          fs,
+		store:       store,
+		canonical:   make(map[string]string),
+		linked:      make(map[string]bool),
+	}
+}
+
+func (s *fileSink) Observe(_ context.Context, obs Observation) error {
+	for i, cert := range obs.Chain {
+		sum1 := sha1.Sum(cert.Raw)
+		digest := hex.EncodeToString(sum1[:])
+		sum := sha256.Sum256(cert.Raw)
+		digest256 := hex.EncodeToString(sum[:])
+
+		if s.options.files() {
+			if err := s.place(obs, i, digest, digest256); err != nil {
+				return err
+			}
+		}
+
+		if s.store != nil {
+			err := s.try(func() error { return s.store.sight(digest256, digest, obs) })
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *fileSink) Close() error {
+	return nil
+}
+
+// place writes the files of the i-th certificate of a chain to the directory
+// the layout puts it in. A certificate is written once, other directories it
+// belongs in are links to that canonical copy.
+func (s *fileSink) place(obs Observation, i int, sha1, sha256 string) error {
+	path := s.layoutDir(obs, i, sha1, sha256)
+	canonical, ok := s.canonical[sha256]
+	if !ok {
+		if err := s.writeCertificate(path, obs.Chain[i]); err != nil {
+			return err
+		}
+		s.canonical[sha256] = path
+		canonical = path
+	} else if path != canonical {
+		if err := s.try(func() error { return s.link(canonical, path) }); err != nil {
+			return err
+		}
+	}
+
+	if s.options.index {
+		return s.index(obs, i, canonical)
+	}
+	return nil
+}
+
+// certDir returns the directory holding the canonical copy of the files of
+// cert, once they have been written.
+func (s *fileSink) certDir(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return s.canonical[hex.EncodeToString(sum[:])]
+}
+
+// writeCertificate writes the enabled formats of cert to path. Files that
+// already exist in the store are left alone, certificates never change.
+// Where and when a certificate was seen is left to the certificate log, the
+// event log and the store's sightings.json, so that the files only depend on
+// the certificate.
+func (s *fileSink) writeCertificate(path string, cert *x509.Certificate) error {
+	if err := s.try(func() error { return s.fs.mkdirAll(path) }); err != nil {
+		return err
+	}
+
+	for _, f := range []struct {
+		name    string
+		enabled bool
+		encode  func() ([]byte, error)
+	}{
+		{"cert.der", s.options.der, func() ([]byte, error) {
+			return cert.Raw, nil
+		}},
+		{"cert.pem", s.options.pem, func() ([]byte, error) {
+			return pemCertificates([]*x509.Certificate{cert}), nil
+		}},
+		{"cert.txt", s.options.text, func() ([]byte, error) {
+			return []byte(certificateText(cert)), nil
+		}},
+		{"cert.json", s.options.json, func() ([]byte, error) {
+			return json.MarshalIndent(NewCertificate(cert), "", "  ")
+		}},
+	} {
+		if !f.enabled || !s.shouldWrite(path, f.name) {
+			continue
+		}
+		data, err := f.encode()
+		if err != nil {
+			return err
+		}
+		file := filepath.Join(path, f.name)
+		err = s.try(func() error { return s.fs.writeFile(file, data, 0644) })
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *fileSink) shouldWrite(path, name string) bool {
+	if s.store == nil {
+		return true
+	}
+	return !s.fs.exists(filepath.Join(path, name))
+}
@@ -0,0 +1,236 @@
+package certgrep
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// flowKey identifies one direction of a TCP connection.
+type flowKey struct {
+	netflow gopacket.Flow
+	tcpflow gopacket.Flow
+}
+
+func (k flowKey) reverse() flowKey {
+	return flowKey{
+		netflow: k.netflow.Reverse(),
+		tcpflow: k.tcpflow.Reverse(),
+	}
+}
+
+// flowTable keeps track of flow directions that have nothing left to offer.
+// Once a stream handler has processed the server flight, or decided that a
+// stream is not TLS, the packet loop drops everything else for that direction
+// before it reaches the assembler. With classification enabled, directions
+// whose first payload can't lead to a TLS handshake are dropped right away.
+type flowTable struct {
+	// accessed atomically, keep 64-bit aligned
+	skippedBytes   uint64
+	skippedPackets uint64
+	rejectedFlows  uint64
+
+	classify bool
+
+	mu       sync.Mutex
+	done     map[flowKey]time.Time
+	admitted map[flowKey]time.Time
+	// ClientHello records still being collected, and the parsed result
+	hellos       map[flowKey]*helloBuffer
+	clientHellos map[flowKey]*parsedHello
+	// timestamp of the most recent packet offered to admit
+	last time.Time
+}
+
+// helloBuffer collects the segments of a ClientHello record. The packet loop
+// sees the ClientHello before the server's response, so once the server flight
+// has been read by a stream handler, the client's hello is known.
+type helloBuffer struct {
+	next uint32
+	data []byte
+	seen time.Time
+}
+
+type parsedHello struct {
+	hello *clientHello
+	seen  time.Time
+}
+
+func newFlowTable(classify bool) *flowTable {
+	return &flowTable{
+		classify:     classify,
+		done:         make(map[flowKey]time.Time),
+		admitted:     make(map[flowKey]time.Time),
+		hellos:       make(map[flowKey]*helloBuffer),
+		clientHellos: make(map[flowKey]*parsedHello),
+	}
+}
+
+// markDone flags a single direction as finished.
+func (t *flowTable) markDone(netflow, tcpflow gopacket.Flow) {
+	t.mu.Lock()
+	t.done[flowKey{netflow, tcpflow}] = t.last
+	t.mu.Unlock()
+}
+
+// markConnectionDone flags both directions of a connection as finished.
+func (t *flowTable) markConnectionDone(netflow, tcpflow gopacket.Flow) {
+	k := flowKey{netflow, tcpflow}
+	t.mu.Lock()
+	t.done[k] = t.last
+	t.done[k.reverse()] = t.last
+	t.mu.Unlock()
+}
+
+// admit reports whether the packet should be handed to the assembler. Packets
+// of finished directions are counted and refresh the entry so it isn't expired
+// while the connection is still active. The first payload of every other
+// direction is classified; packets without payload pass so the assembler
+// still sees the SYN. A SYN starting a connection clears what is known of an
+// earlier one on the same tuple.
+func (t *flowTable) admit(netflow gopacket.Flow, tcp *layers.TCP, size int, seen time.Time) bool {
+	k := flowKey{netflow, tcp.TransportFlow()}
+	payload := tcp.Payload
+	t.mu.Lock()
+	t.last = seen
+
+	if tcp.SYN && !tcp.ACK {
+		// a new connection reusing the tuple of an earlier one
+		t.forget(k)
+	}
+
+	if _, ok := t.done[k]; ok {
+		t.done[k] = seen
+		t.mu.Unlock()
+		t.countSkipped(size)
+		return false
+	}
+
+	if len(payload) > 0 {
+		t.collectClientHello(k, tcp.Seq, payload, seen)
+	}
+
+	if !t.classify || len(payload) == 0 {
+		t.mu.Unlock()
+		return true
+	}
+
+	if _, ok := t.admitted[k]; ok {
+		t.admitted[k] = seen
+		t.mu.Unlock()
+		return true
+	}
+
+	if classifyPayload(payload) == verdictReject {
+		t.done[k] = seen
+		t.mu.Unlock()
+		atomic.AddUint64(&t.rejectedFlows, 1)
+		t.countSkipped(size)
+		return false
+	}
+
+	t.admitted[k] = seen
+	t.mu.Unlock()
+	return true
+}
+
+// forget drops what is known about both directions of the connection of k.
+// Must be called with t.mu held.
+func (t *flowTable) forget(k flowKey) {
+	for _, k := range []flowKey{k, k.reverse()} {
+		delete(t.done, k)
+		delete(t.admitted, k)
+		delete(t.hellos, k)
+		delete(t.clientHellos, k)
+	}
+}
+
+// collectClientHello buffers the ClientHello record of a direction, if it
+// starts with one, until it is complete. Must be called with t.mu held.
+func (t *flowTable) collectClientHello(k flowKey, seq uint32, payload []byte, seen time.Time) {
+	if _, ok := t.clientHellos[k]; ok {
+		return
+	}
+
+	b, ok := t.hellos[k]
+	if !ok {
+		if !isClientHelloRecord(payload) {
+			return
+		}
+		b = &helloBuffer{next: seq}
+		t.hellos[k] = b
+	}
+
+	if seq != b.next {
+		// retransmission or reordering, don't bother
+		delete(t.hellos, k)
+		return
+	}
+
+	b.data = append(b.data, payload...)
+	b.next += uint32(len(payload))
+	b.seen = seen
+
+	if need := recordLen(b.data); len(b.data) >= need || len(b.data) >= maxRecordLen {
+		delete(t.hellos, k)
+		hello, err := parseClientHelloRecord(b.data)
+		if err == nil {
+			t.clientHellos[k] = &parsedHello{hello: hello, seen: seen}
+		}
+	}
+}
+
+// clientHello returns the ClientHello sent in the opposite direction of the
+// given server to client flow, if one was seen.
+func (t *flowTable) clientHello(netflow, tcpflow gopacket.Flow) *clientHello {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if p, ok := t.clientHellos[flowKey{netflow, tcpflow}.reverse()]; ok {
+		return p.hello
+	}
+	return nil
+}
+
+func (t *flowTable) countSkipped(size int) {
+	atomic.AddUint64(&t.skippedBytes, uint64(size))
+	atomic.AddUint64(&t.skippedPackets, 1)
+}
+
+// expire forgets directions that haven't seen a packet since olderThan.
+func (t *flowTable) expire(olderThan time.Time) (n int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for k, seen := range t.done {
+		if seen.Before(olderThan) {
+			delete(t.done, k)
+			n++
+		}
+	}
+	for k, seen := range t.admitted {
+		if seen.Before(olderThan) {
+			delete(t.admitted, k)
+		}
+	}
+	for k, b := range t.hellos {
+		if b.seen.Before(olderThan) {
+			delete(t.hellos, k)
+		}
+	}
+	for k, p := range t.clientHellos {
+		if p.seen.Before(olderThan) {
+			delete(t.clientHellos, k)
+		}
+	}
+	return
+}
+
+func (t *flowTable) skipped() (bytes, packets uint64) {
+	return atomic.LoadUint64(&t.skippedBytes), atomic.LoadUint64(&t.skippedPackets)
+}
+
+func (t *flowTable) rejected() uint64 {
+	return atomic.LoadUint64(&t.rejectedFlows)
+}
@@ -0,0 +1,134 @@
+package certgrep
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// tcpPacket builds and decodes a TCP segment between 10.0.0.1:51000, the
+// client, and 10.0.0.2:443.
+func tcpPacket(t *testing.T, fromClient, syn, ack bool, payload string) (gopacket.Flow, *layers.TCP) {
+	t.Helper()
+	client, server := net.IP{10, 0, 0, 1}, net.IP{10, 0, 0, 2}
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: server, DstIP: client}
+	tcp := &layers.TCP{SrcPort: 443, DstPort: 51000, SYN: syn, ACK: ack, Window: 1024}
+	if fromClient {
+		ip.SrcIP, ip.DstIP = client, server
+		tcp.SrcPort, tcp.DstPort = tcp.DstPort, tcp.SrcPort
+	}
+	if err := tcp.SetNetworkLayerForChecksum(ip); err != nil {
+		t.Fatal(err)
+	}
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, ip, tcp, gopacket.Payload(payload)); err != nil {
+		t.Fatal(err)
+	}
+	packet := gopacket.NewPacket(buf.Bytes(), layers.LayerTypeIPv4, gopacket.Default)
+	return packet.NetworkLayer().NetworkFlow(), packet.Layer(layers.LayerTypeTCP).(*layers.TCP)
+}
+
+func TestFlowTableAdmit(t *testing.T) {
+	type step struct {
+		name       string
+		fromClient bool
+		syn, ack   bool
+		payload    string
+		want       bool
+		// mark the connection done after the packet
+		done bool
+	}
+	tests := []struct {
+		name     string
+		steps    []step
+		skipped  uint64
+		rejected uint64
+	}{
+		{
+			name: "done connection",
+			steps: []step{
+				{name: "syn", fromClient: true, syn: true, want: true},
+				{name: "syn ack", syn: true, ack: true, want: true},
+				{name: "server flight", ack: true, payload: "\x16\x03\x02", want: true, done: true},
+				{name: "server data", ack: true, payload: "\x17\x03\x02", want: false},
+				{name: "client data", fromClient: true, ack: true, payload: "\x17\x03\x02", want: false},
+			},
+			skipped: 2,
+		},
+		{
+			name: "tuple reused",
+			steps: []step{
+				{name: "syn", fromClient: true, syn: true, want: true},
+				{name: "server flight", ack: true, payload: "\x16\x03\x02", want: true, done: true},
+				{name: "server data", ack: true, payload: "\x17\x03\x02", want: false},
+				{name: "new syn", fromClient: true, syn: true, want: true},
+				{name: "new server flight", ack: true, payload: "\x16\x03\x02", want: true},
+			},
+			skipped: 1,
+		},
+		{
+			name: "rejected then reused",
+			steps: []step{
+				{name: "syn", fromClient: true, syn: true, want: true},
+				{name: "ssh banner", ack: true, payload: "SSH-2.0-OpenSSH_8.9\r\n", want: false},
+				{name: "ssh data", ack: true, payload: "more", want: false},
+				{name: "new syn", fromClient: true, syn: true, want: true},
+				{name: "server flight", ack: true, payload: "\x16\x03\x02", want: true},
+			},
+			skipped:  2,
+			rejected: 1,
+		},
+		{
+			name: "retransmitted syn ack",
+			steps: []step{
+				{name: "server flight", ack: true, payload: "\x16\x03\x02", want: true, done: true},
+				{name: "syn ack", syn: true, ack: true, want: false},
+			},
+			skipped: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flows := newFlowTable(true)
+			seen := time.Date(2020, 2, 1, 0, 0, 0, 0, time.UTC)
+			for _, s := range tt.steps {
+				netflow, tcp := tcpPacket(t, s.fromClient, s.syn, s.ack, s.payload)
+				if got := flows.admit(netflow, tcp, 100, seen); got != s.want {
+					t.Errorf("%s: admit() = %v, want %v", s.name, got, s.want)
+				}
+				if s.done {
+					flows.markConnectionDone(netflow, tcp.TransportFlow())
+				}
+				seen = seen.Add(time.Millisecond)
+			}
+			if _, packets := flows.skipped(); packets != tt.skipped {
+				t.Errorf("skipped %d packets, want %d", packets, tt.skipped)
+			}
+			if rejected := flows.rejected(); rejected != tt.rejected {
+				t.Errorf("rejected %d flows, want %d", rejected, tt.rejected)
+			}
+		})
+	}
+}
+
+func TestFlowTableExpire(t *testing.T) {
+	flows := newFlowTable(true)
+	start := time.Date(2020, 2, 1, 0, 0, 0, 0, time.UTC)
+	netflow, tcp := tcpPacket(t, false, false, true, "\x16\x03\x02")
+	flows.admit(netflow, tcp, 100, start)
+	flows.markConnectionDone(netflow, tcp.TransportFlow())
+
+	if n := flows.expire(start); n != 0 {
+		t.Fatalf("expire() = %d before the cutoff, want 0", n)
+	}
+	if n := flows.expire(start.Add(time.Minute)); n != 2 {
+		t.Fatalf("expire() = %d, want 2", n)
+	}
+	if !flows.admit(netflow, tcp, 100, start.Add(2*time.Minute)) {
+		t.Error("expired flow still dropped")
+	}
+}
@@ -3,22 +3,30 @@ module github.com/kung-foo/certgrep
 go 1.17
 
 require (
-	github.com/davecgh/go-spew v1.1.0
 	github.com/docopt/docopt-go v0.0.0-20160216232012-784ddc588536
 	github.com/google/gopacket v1.1.19
+	github.com/klauspost/compress v1.15.15
 	github.com/mattn/go-isatty v0.0.3
+	github.com/mattn/go-sqlite3 v1.14.6
 	github.com/mgutz/ansi v0.0.0-20170206155736-9520e82c474b
 	github.com/olekukonko/tablewriter v0.0.0-20180506121414-d4647c9c7a84
-	github.com/pkg/errors v0.8.0
+	github.com/pkg/errors v0.9.1
 	github.com/pkg/profile v1.2.1
+	github.com/xitongsys/parquet-go v1.6.2
+	github.com/xitongsys/parquet-go-source v0.0.0-20200817004010-026bad9b25d0
 	go.uber.org/zap v1.9.1
+	golang.org/x/sys v0.0.0-20200223170610-d5e6a3e2c0ae
 )
 
 require (
+	github.com/apache/arrow/go/arrow v0.0.0-20200730104253-651201b0f516 // indirect
+	github.com/apache/thrift v0.14.2 // indirect
+	github.com/golang/snappy v0.0.3 // indirect
 	github.com/mattn/go-colorable v0.0.9 // indirect
 	github.com/mattn/go-runewidth v0.0.3 // indirect
-	github.com/stretchr/testify v1.7.0 // indirect
+	github.com/pierrec/lz4/v4 v4.1.8 // indirect
 	go.uber.org/atomic v1.3.2 // indirect
 	go.uber.org/multierr v1.1.0 // indirect
-	golang.org/x/sys v0.0.0-20190412213103-97732733099d // indirect
+	golang.org/x/net v0.0.0-20200222125558-5a598a2470a0 // indirect
+	golang.org/x/xerrors v0.0.0-20191204190536-9bdfabe68543 // indirect
 )
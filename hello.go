@@ -0,0 +1,370 @@
+package certgrep
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	recordTypeChangeCipherSpec    = 0x14
+	recordTypeHandshake           = 0x16
+	handshakeTypeClientHello      = 0x01
+	handshakeTypeServerHello      = 0x02
+	handshakeTypeNewSessionTicket = 0x04
+
+	versionTLS13 = 0x0304
+
+	extensionServerName        = 0
+	extensionSupportedGroups   = 10
+	extensionECPointFormats    = 11
+	extensionALPN              = 16
+	extensionSupportedVersions = 43
+
+	recordHeaderLen = 5
+	maxRecordLen    = recordHeaderLen + 1<<14
+)
+
+var (
+	errShortClientHello = errors.New("truncated ClientHello")
+	errShortServerHello = errors.New("truncated ServerHello")
+)
+
+// clientHello holds the parts of a ClientHello certgrep cares about. Lists are
+// kept in wire order.
+type clientHello struct {
+	Version           uint16
+	CipherSuites      []uint16
+	Extensions        []uint16
+	SupportedGroups   []uint16
+	ECPointFormats    []uint8
+	SupportedVersions []uint16
+	ServerName        string
+	ALPN              []string
+}
+
+// serverHello holds the parts of a ServerHello certgrep cares about.
+type serverHello struct {
+	Version     uint16
+	CipherSuite uint16
+	Extensions  []uint16
+	// selected with the supported_versions extension (TLS 1.3)
+	SupportedVersion uint16
+}
+
+// negotiatedVersion returns the protocol version chosen by the server.
+func (hello *serverHello) negotiatedVersion() uint16 {
+	if hello.SupportedVersion != 0 {
+		return hello.SupportedVersion
+	}
+	return hello.Version
+}
+
+// isClientHelloRecord reports whether payload starts with a handshake record
+// carrying a ClientHello.
+func isClientHelloRecord(payload []byte) bool {
+	return len(payload) > recordHeaderLen &&
+		payload[0] == recordTypeHandshake &&
+		payload[1] == 0x03 &&
+		payload[recordHeaderLen] == handshakeTypeClientHello
+}
+
+// recordLen returns the length of the record starting at payload, header
+// included.
+func recordLen(payload []byte) int {
+	return recordHeaderLen + int(binary.BigEndian.Uint16(payload[3:5]))
+}
+
+// byteString is a minimal cursor over length prefixed TLS structures.
+type byteString []byte
+
+func (b *byteString) skip(n int) bool {
+	if len(*b) < n {
+		return false
+	}
+	*b = (*b)[n:]
+	return true
+}
+
+func (b *byteString) readUint8(v *uint8) bool {
+	if len(*b) < 1 {
+		return false
+	}
+	*v = (*b)[0]
+	*b = (*b)[1:]
+	return true
+}
+
+func (b *byteString) readUint16(v *uint16) bool {
+	if len(*b) < 2 {
+		return false
+	}
+	*v = binary.BigEndian.Uint16(*b)
+	*b = (*b)[2:]
+	return true
+}
+
+func (b *byteString) readPrefixed(size int, out *byteString) bool {
+	if len(*b) < size {
+		return false
+	}
+	var n int
+	for _, c := range (*b)[:size] {
+		n = n<<8 | int(c)
+	}
+	if len(*b) < size+n {
+		return false
+	}
+	*out = (*b)[size : size+n]
+	*b = (*b)[size+n:]
+	return true
+}
+
+// parseClientHelloRecord parses a complete handshake record holding a
+// ClientHello.
+func parseClientHelloRecord(record []byte) (*clientHello, error) {
+	if !isClientHelloRecord(record) || len(record) < recordLen(record) {
+		return nil, errShortClientHello
+	}
+	body := byteString(record[recordHeaderLen:recordLen(record)])
+
+	var msg byteString
+	if !body.skip(1) || !body.readPrefixed(3, &msg) {
+		return nil, errShortClientHello
+	}
+
+	hello := &clientHello{}
+	var sessionID, suites, compression byteString
+	if !msg.readUint16(&hello.Version) || !msg.skip(32) ||
+		!msg.readPrefixed(1, &sessionID) ||
+		!msg.readPrefixed(2, &suites) ||
+		!msg.readPrefixed(1, &compression) {
+		return nil, errShortClientHello
+	}
+
+	for len(suites) > 0 {
+		var suite uint16
+		if !suites.readUint16(&suite) {
+			return nil, errShortClientHello
+		}
+		hello.CipherSuites = append(hello.CipherSuites, suite)
+	}
+
+	// no extensions at all
+	if len(msg) == 0 {
+		return hello, nil
+	}
+
+	var extensions byteString
+	if !msg.readPrefixed(2, &extensions) {
+		return nil, errShortClientHello
+	}
+
+	for len(extensions) > 0 {
+		var (
+			typ  uint16
+			data byteString
+		)
+		if !extensions.readUint16(&typ) || !extensions.readPrefixed(2, &data) {
+			return nil, errShortClientHello
+		}
+		hello.Extensions = append(hello.Extensions, typ)
+
+		if !hello.parseExtension(typ, data) {
+			return nil, errShortClientHello
+		}
+	}
+
+	return hello, nil
+}
+
+// parseServerHello parses the ServerHello at the start of a handshake record.
+// Unlike a ClientHello the record may also hold the following handshake
+// messages, only the ServerHello itself needs to be present.
+func parseServerHello(record []byte) (*serverHello, error) {
+	if len(record) <= recordHeaderLen ||
+		record[0] != recordTypeHandshake ||
+		record[recordHeaderLen] != handshakeTypeServerHello {
+		return nil, errShortServerHello
+	}
+	body := byteString(record[recordHeaderLen:])
+
+	var msg byteString
+	if !body.skip(1) || !body.readPrefixed(3, &msg) {
+		return nil, errShortServerHello
+	}
+
+	hello := &serverHello{}
+	var sessionID byteString
+	if !msg.readUint16(&hello.Version) || !msg.skip(32) ||
+		!msg.readPrefixed(1, &sessionID) ||
+		!msg.readUint16(&hello.CipherSuite) ||
+		!msg.skip(1) {
+		return nil, errShortServerHello
+	}
+
+	if len(msg) == 0 {
+		return hello, nil
+	}
+
+	var extensions byteString
+	if !msg.readPrefixed(2, &extensions) {
+		return nil, errShortServerHello
+	}
+
+	for len(extensions) > 0 {
+		var (
+			typ  uint16
+			data byteString
+		)
+		if !extensions.readUint16(&typ) || !extensions.readPrefixed(2, &data) {
+			return nil, errShortServerHello
+		}
+		hello.Extensions = append(hello.Extensions, typ)
+
+		if typ == extensionSupportedVersions && !data.readUint16(&hello.SupportedVersion) {
+			return nil, errShortServerHello
+		}
+	}
+
+	return hello, nil
+}
+
+// peekServerHello parses the ServerHello at the front of r without consuming
+// anything.
+func peekServerHello(r *bufio.Reader) (*serverHello, error) {
+	header, err := r.Peek(recordHeaderLen + 4)
+	if err != nil {
+		return nil, err
+	}
+	msgLen := int(header[6])<<16 | int(header[7])<<8 | int(header[8])
+	record, err := r.Peek(recordHeaderLen + 4 + msgLen)
+	if err != nil {
+		return nil, err
+	}
+	return parseServerHello(record)
+}
+
+// peekResumption reports whether the ServerHello at the front of r is
+// followed by a session ticket or a ChangeCipherSpec, the abbreviated
+// handshake of a resumed session, without consuming anything.
+func peekResumption(r *bufio.Reader) bool {
+	header, err := r.Peek(recordHeaderLen + 4)
+	if err != nil {
+		return false
+	}
+	recordLen := int(header[3])<<8 | int(header[4])
+	msgLen := int(header[6])<<16 | int(header[7])<<8 | int(header[8])
+	next := recordHeaderLen + 4 + msgLen
+	if 4+msgLen < recordLen {
+		// the next message is in the same record
+		b, err := r.Peek(next + 1)
+		return err == nil && b[next] == handshakeTypeNewSessionTicket
+	}
+	next = recordHeaderLen + recordLen
+	b, err := r.Peek(next + recordHeaderLen + 1)
+	if err != nil {
+		return false
+	}
+	switch b[next] {
+	case recordTypeChangeCipherSpec:
+		return true
+	case recordTypeHandshake:
+		return b[next+recordHeaderLen] == handshakeTypeNewSessionTicket
+	}
+	return false
+}
+
+func (hello *clientHello) parseExtension(typ uint16, data byteString) bool {
+	switch typ {
+	case extensionServerName:
+		var names byteString
+		if !data.readPrefixed(2, &names) {
+			return false
+		}
+		for len(names) > 0 {
+			var (
+				nameType uint8
+				name     byteString
+			)
+			if !names.readUint8(&nameType) || !names.readPrefixed(2, &name) {
+				return false
+			}
+			if nameType == 0 {
+				hello.ServerName = string(name)
+			}
+		}
+	case extensionSupportedGroups:
+		var groups byteString
+		if !data.readPrefixed(2, &groups) {
+			return false
+		}
+		for len(groups) > 0 {
+			var group uint16
+			if !groups.readUint16(&group) {
+				return false
+			}
+			hello.SupportedGroups = append(hello.SupportedGroups, group)
+		}
+	case extensionECPointFormats:
+		var formats byteString
+		if !data.readPrefixed(1, &formats) {
+			return false
+		}
+		hello.ECPointFormats = append(hello.ECPointFormats, formats...)
+	case extensionALPN:
+		var protos byteString
+		if !data.readPrefixed(2, &protos) {
+			return false
+		}
+		for len(protos) > 0 {
+			var proto byteString
+			if !protos.readPrefixed(1, &proto) {
+				return false
+			}
+			hello.ALPN = append(hello.ALPN, string(proto))
+		}
+	case extensionSupportedVersions:
+		var versions byteString
+		if !data.readPrefixed(1, &versions) {
+			return false
+		}
+		for len(versions) > 0 {
+			var v uint16
+			if !versions.readUint16(&v) {
+				return false
+			}
+			hello.SupportedVersions = append(hello.SupportedVersions, v)
+		}
+	}
+	return true
+}
+
+// versionName returns the conventional name of a TLS protocol version.
+func versionName(v uint16) string {
+	switch v {
+	case 0:
+		return ""
+	case 0x0300:
+		return "SSLv3"
+	case 0x0301:
+		return "TLSv1"
+	case 0x0302:
+		return "TLSv1.1"
+	case 0x0303:
+		return "TLSv1.2"
+	case 0x0304:
+		return "TLSv1.3"
+	}
+	return fmt.Sprintf("0x%04x", v)
+}
+
+// cipherSuiteName returns the IANA name of a cipher suite.
+func cipherSuiteName(id uint16) string {
+	if id == 0 {
+		return ""
+	}
+	return tls.CipherSuiteName(id)
+}
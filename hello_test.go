@@ -0,0 +1,158 @@
+package certgrep
+
+import (
+	"reflect"
+	"testing"
+)
+
+// u16 encodes values as big endian uint16s.
+func u16(values ...uint16) []byte {
+	var b []byte
+	for _, v := range values {
+		b = append(b, byte(v>>8), byte(v))
+	}
+	return b
+}
+
+// prefixed prepends the size byte long length of body.
+func prefixed(size int, body ...[]byte) []byte {
+	b := join(body...)
+	n := len(b)
+	var prefix []byte
+	for i := size - 1; i >= 0; i-- {
+		prefix = append(prefix, byte(n>>(8*i)))
+	}
+	return append(prefix, b...)
+}
+
+func extension(typ uint16, data ...[]byte) []byte {
+	return join(u16(typ), prefixed(2, data...))
+}
+
+// clientHelloRecord builds a ClientHello record, extensions is nil for a
+// ClientHello without the extensions block.
+func clientHelloRecord(suites []uint16, extensions ...[]byte) []byte {
+	msg := join(u16(0x0303), make([]byte, 32), prefixed(1), prefixed(2, u16(suites...)), prefixed(1, []byte{0}))
+	if extensions != nil {
+		msg = join(msg, prefixed(2, extensions...))
+	}
+	return record(recordTypeHandshake, handshake(handshakeTypeClientHello, msg))
+}
+
+var fullClientHello = clientHelloRecord(
+	[]uint16{0x1a1a, 0x1301, 0xc02f, 0x002f},
+	extension(0x2a2a),
+	extension(extensionServerName, prefixed(2, []byte{0}, prefixed(2, []byte("example.com")))),
+	extension(extensionSupportedGroups, prefixed(2, u16(0x0a0a, 29, 23))),
+	extension(extensionECPointFormats, prefixed(1, []byte{0})),
+	extension(extensionALPN, prefixed(2, prefixed(1, []byte("h2")), prefixed(1, []byte("http/1.1")))),
+	extension(extensionSupportedVersions, prefixed(1, u16(0x0304, 0x0303))),
+	extension(0xff01, []byte{0}),
+)
+
+func TestParseClientHelloRecord(t *testing.T) {
+	tests := []struct {
+		name   string
+		record []byte
+		want   *clientHello
+	}{
+		{
+			name:   "full",
+			record: fullClientHello,
+			want: &clientHello{
+				Version:           0x0303,
+				CipherSuites:      []uint16{0x1a1a, 0x1301, 0xc02f, 0x002f},
+				Extensions:        []uint16{0x2a2a, 0, 10, 11, 16, 43, 0xff01},
+				SupportedGroups:   []uint16{0x0a0a, 29, 23},
+				ECPointFormats:    []uint8{0},
+				SupportedVersions: []uint16{0x0304, 0x0303},
+				ServerName:        "example.com",
+				ALPN:              []string{"h2", "http/1.1"},
+			},
+		},
+		{
+			name:   "no extensions",
+			record: clientHelloRecord([]uint16{0x002f}),
+			want:   &clientHello{Version: 0x0303, CipherSuites: []uint16{0x002f}},
+		},
+		{
+			name:   "empty extensions",
+			record: clientHelloRecord([]uint16{0x002f}, []byte{}),
+			want:   &clientHello{Version: 0x0303, CipherSuites: []uint16{0x002f}},
+		},
+		{name: "truncated record", record: fullClientHello[:len(fullClientHello)-1]},
+		{name: "header only", record: fullClientHello[:recordHeaderLen+1]},
+		{
+			name:   "extension overflows",
+			record: clientHelloRecord([]uint16{0x002f}, u16(extensionServerName, 10), []byte{0, 8}),
+		},
+		{
+			name:   "server name overflows",
+			record: clientHelloRecord([]uint16{0x002f}, extension(extensionServerName, u16(20), []byte{0}, u16(4), []byte("a"))),
+		},
+		{name: "not a client hello", record: stream1Hello},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseClientHelloRecord(tt.record)
+			if tt.want == nil {
+				if err != errShortClientHello {
+					t.Fatalf("error = %v, want %v", err, errShortClientHello)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseServerHello(t *testing.T) {
+	tests := []struct {
+		name    string
+		record  []byte
+		want    *serverHello
+		version uint16
+	}{
+		{
+			name:    "tls 1.1",
+			record:  stream1Hello,
+			want:    &serverHello{Version: 0x0302, CipherSuite: 0xc014, Extensions: []uint16{0xff01}},
+			version: 0x0302,
+		},
+		{
+			name:   "tls 1.3",
+			record: tls13Hello,
+			want: &serverHello{Version: 0x0303, CipherSuite: 0x1301, Extensions: []uint16{43},
+				SupportedVersion: 0x0304},
+			version: 0x0304,
+		},
+		{name: "truncated", record: stream1Hello[:40]},
+		{name: "client hello", record: fullClientHello},
+		{name: "alert", record: handshakeAlert},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseServerHello(tt.record)
+			if tt.want == nil {
+				if err != errShortServerHello {
+					t.Fatalf("error = %v, want %v", err, errShortServerHello)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+			if v := got.negotiatedVersion(); v != tt.version {
+				t.Errorf("negotiatedVersion() = %#04x, want %#04x", v, tt.version)
+			}
+		})
+	}
+}
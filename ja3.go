@@ -0,0 +1,57 @@
+package certgrep
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"strconv"
+	"strings"
+)
+
+// ja3 returns the JA3 fingerprint string of a ClientHello:
+// SSLVersion,Ciphers,Extensions,EllipticCurves,EllipticCurvePointFormats.
+// GREASE values are left out.
+func (hello *clientHello) ja3() string {
+	formats := make([]uint16, len(hello.ECPointFormats))
+	for i, f := range hello.ECPointFormats {
+		formats[i] = uint16(f)
+	}
+	return strings.Join([]string{
+		strconv.Itoa(int(hello.Version)),
+		ja3List(hello.CipherSuites),
+		ja3List(hello.Extensions),
+		ja3List(hello.SupportedGroups),
+		ja3List(formats),
+	}, ",")
+}
+
+// ja3s returns the JA3S fingerprint string of a ServerHello:
+// SSLVersion,Cipher,Extensions.
+func (hello *serverHello) ja3s() string {
+	return strings.Join([]string{
+		strconv.Itoa(int(hello.Version)),
+		strconv.Itoa(int(hello.CipherSuite)),
+		ja3List(hello.Extensions),
+	}, ",")
+}
+
+// ja3Hash returns the MD5 digest of a JA3 or JA3S string.
+func ja3Hash(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func ja3List(values []uint16) string {
+	list := make([]string, 0, len(values))
+	for _, v := range values {
+		if isGREASE(v) {
+			continue
+		}
+		list = append(list, strconv.Itoa(int(v)))
+	}
+	return strings.Join(list, "-")
+}
+
+// isGREASE reports whether v is one of the reserved values of RFC 8701.
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
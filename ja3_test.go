@@ -0,0 +1,80 @@
+package certgrep
+
+import "testing"
+
+func TestJA3(t *testing.T) {
+	tests := []struct {
+		name  string
+		hello *clientHello
+		want  string
+	}{
+		{
+			// the example of the JA3 README
+			name: "reference",
+			hello: &clientHello{
+				Version:         769,
+				CipherSuites:    []uint16{47, 53, 5, 10, 49161, 49162, 49171, 49172, 50, 56, 19, 4},
+				Extensions:      []uint16{0, 10, 11},
+				SupportedGroups: []uint16{23, 24, 25},
+				ECPointFormats:  []uint8{0},
+			},
+			want: "769,47-53-5-10-49161-49162-49171-49172-50-56-19-4,0-10-11,23-24-25,0",
+		},
+		{
+			name:  "grease",
+			hello: mustParseClientHello(t, fullClientHello),
+			want:  "771,4865-49199-47,0-10-11-16-43-65281,29-23,0",
+		},
+		{
+			name:  "no extensions",
+			hello: &clientHello{Version: 771, CipherSuites: []uint16{47}},
+			want:  "771,47,,,",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.hello.ja3(); got != tt.want {
+				t.Errorf("ja3() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJA3S(t *testing.T) {
+	hello, err := parseServerHello(stream1Hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := hello.ja3s(), "770,49172,65281"; got != want {
+		t.Errorf("ja3s() = %q, want %q", got, want)
+	}
+}
+
+func TestJA3Hash(t *testing.T) {
+	got := ja3Hash("769,47-53-5-10-49161-49162-49171-49172-50-56-19-4,0-10-11,23-24-25,0")
+	if want := "ada70206e40642a3e4461f35503241d5"; got != want {
+		t.Errorf("ja3Hash() = %q, want %q", got, want)
+	}
+}
+
+func TestIsGREASE(t *testing.T) {
+	// the 16 values reserved by RFC 8701
+	grease := map[uint16]bool{}
+	for i := uint16(0); i < 16; i++ {
+		grease[i<<12|0x0a00|i<<4|0x0a] = true
+	}
+	for v := 0; v <= 0xffff; v++ {
+		if got := isGREASE(uint16(v)); got != grease[uint16(v)] {
+			t.Fatalf("isGREASE(%#04x) = %v", v, got)
+		}
+	}
+}
+
+func mustParseClientHello(t *testing.T, record []byte) *clientHello {
+	t.Helper()
+	hello, err := parseClientHelloRecord(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hello
+}
@@ -0,0 +1,140 @@
+package certgrep
+
+import (
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Directory layouts of the output directory. The store is content addressed
+// and always uses its own layout.
+const (
+	// <output>/<sha1>/
+	LayoutFingerprint = "fingerprint"
+	// <output>/<server ip>_<port>/<sha1>/
+	LayoutServer = "server"
+	// <output>/<SNI, or the leaf's CN>/<sha1>/
+	LayoutName = "name"
+	// <output>/<issuer CN>/<sha1>/
+	LayoutIssuer = "issuer"
+)
+
+const (
+	datePartitionFormat = "2006/01/02"
+	expiryMonthFormat   = "2006-01"
+)
+
+var (
+	// common name chars allowed in file name
+	allowedCNCchars = regexp.MustCompile(`([^a-zA-Z0-9_\.\-])`)
+)
+
+func cleanupName(name string) string {
+	// keep wildcard names apart from their parent domain
+	n := strings.Replace(name, "*", "_", -1)
+	n = allowedCNCchars.ReplaceAllLiteralString(n, "")
+	if len(n) > 256 {
+		n = n[0:256]
+	}
+	if n == "" || n == "." || n == ".." {
+		return "_"
+	}
+	return n
+}
+
+func isLayout(layout string) bool {
+	switch layout {
+	case LayoutFingerprint, LayoutServer, LayoutName, LayoutIssuer:
+		return true
+	}
+	return false
+}
+
+// layoutDir returns the directory the i-th certificate of a chain belongs in.
+func (s *fileSink) layoutDir(obs Observation, i int, sha1, sha256 string) string {
+	if s.store != nil {
+		return s.store.certDir(sha256)
+	}
+
+	cert := obs.Chain[i]
+	parts := []string{s.options.dir}
+	if s.options.datePartition {
+		parts = append(parts, filepath.FromSlash(obs.seen().UTC().Format(datePartitionFormat)))
+	}
+	switch s.options.layout {
+	case LayoutServer:
+		parts = append(parts, serverDirName(obs.Server))
+	case LayoutName:
+		name := obs.ServerName
+		if name == "" {
+			name = obs.Chain[0].Subject.CommonName
+		}
+		parts = append(parts, cleanupName(name))
+	case LayoutIssuer:
+		parts = append(parts, cleanupName(issuerName(cert)))
+	}
+	return filepath.Join(append(parts, sha1)...)
+}
+
+// index links the canonical copy of the i-th certificate of a chain into the
+// by-host, by-issuer and by-expiry-month trees next to it.
+func (s *fileSink) index(obs Observation, i int, canonical string) error {
+	root := s.options.dir
+	if s.store != nil {
+		root = s.store.dir
+	}
+	cert := obs.Chain[i]
+
+	host := obs.ServerName
+	if host == "" {
+		host = serverDirName(obs.Server)
+	}
+
+	for _, dir := range []string{
+		filepath.Join(root, "by-host", cleanupName(host)),
+		filepath.Join(root, "by-issuer", cleanupName(issuerName(cert))),
+		filepath.Join(root, "by-expiry-month", cert.NotAfter.UTC().Format(expiryMonthFormat)),
+	} {
+		path := filepath.Join(dir, filepath.Base(canonical))
+		if err := s.try(func() error { return s.link(canonical, path) }); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// link creates a relative symlink at path pointing to target, unless it has
+// already been created.
+func (s *fileSink) link(target, path string) error {
+	if s.linked[path] {
+		return nil
+	}
+	if err := s.fs.mkdirAll(filepath.Dir(path)); err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(filepath.Dir(path), target)
+	if err != nil {
+		return err
+	}
+	if err = s.fs.symlink(rel, path); err != nil && !os.IsExist(err) {
+		return err
+	}
+	s.linked[path] = true
+	return nil
+}
+
+// serverDirName turns ip:port into ip_port, IPv6 colons become dashes.
+func serverDirName(server string) string {
+	ip, port := splitHostPort(server)
+	return cleanupName(strings.Replace(ip, ":", "-", -1) + "_" + strconv.Itoa(port))
+}
+
+func issuerName(cert *x509.Certificate) string {
+	if cert.Issuer.CommonName != "" {
+		return cert.Issuer.CommonName
+	}
+	return cert.Issuer.String()
+}
@@ -0,0 +1,10 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !windows
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!windows
+
+package certgrep
+
+// lockFile doesn't lock on this platform, a certificate store must only be
+// written by a single extractor at a time.
+func lockFile(path string) (unlock func() error, err error) {
+	return func() error { return nil }, nil
+}
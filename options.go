@@ -2,10 +2,11 @@ package certgrep
 
 import (
 	"fmt"
-	"os"
-	"path"
+	"io"
+	"net/http"
+	"net/url"
 	"path/filepath"
-	"strings"
+	"regexp"
 	"time"
 
 	"go.uber.org/zap"
@@ -13,6 +14,7 @@ import (
 
 type Option func(*Extractor) error
 
+// Logger sets where the Extractor logs to, nothing is logged by default.
 func Logger(logger *zap.SugaredLogger) Option {
 	return func(e *Extractor) (err error) {
 		e.logger = logger.Named("certgrep")
@@ -20,18 +22,79 @@ func Logger(logger *zap.SugaredLogger) Option {
 	}
 }
 
+// OutputDir sets the directory the run directories are created in. A run
+// writes to a directory named after the capture time of its first packet,
+// so that processing a capture again gives the same name, with a .1, .2, ...
+// suffix if a run directory of that name exists already. Nothing is written
+// to disk without an output directory.
 func OutputDir(dir string) Option {
 	// TODO(jca): check env SUDO_UID|GID and reset?
 	return func(e *Extractor) (err error) {
-		dir, err = filepath.Abs(dir)
-		if err != nil {
-			return
+		e.outputDir, err = filepath.Abs(dir)
+		// created once something is written to it
+		return
+	}
+}
+
+// Layout selects how certificates are grouped in the output directory, one
+// of LayoutFingerprint (the default), LayoutServer, LayoutName or
+// LayoutIssuer. A certificate belonging in several directories is written
+// once and linked from the others.
+func Layout(layout string) Option {
+	return func(e *Extractor) (err error) {
+		if !isLayout(layout) {
+			return fmt.Errorf("invalid layout")
 		}
+		e.outputOptions.layout = layout
+		return
+	}
+}
+
+// DatePartition adds the capture date (YYYY/MM/DD) to the output directory
+// layout.
+func DatePartition(do bool) Option {
+	return func(e *Extractor) (err error) {
+		e.outputOptions.datePartition = do
+		return
+	}
+}
 
-		now := strings.Replace(time.Now().UTC().Format(time.RFC3339), ":", "_", -1)
-		e.outputOptions.dir = path.Join(dir, now)
+// IndexTrees maintains by-host/, by-issuer/ and by-expiry-month/ trees of
+// symlinks to the certificate directories, in the output directory or the
+// store.
+func IndexTrees(do bool) Option {
+	return func(e *Extractor) (err error) {
+		e.outputOptions.index = do
+		return
+	}
+}
+
+// Store writes certificates to a persistent, content addressed store shared
+// between runs instead of the per run output directory. Each certificate is
+// written once and its sightings are tracked in the store.
+func Store(dir string) Option {
+	return func(e *Extractor) (err error) {
+		e.outputOptions.store = dir
+		return
+	}
+}
+
+// Database sets the SQLite database written by the sqlite format. It defaults
+// to certgrep.db in the output directory, point it to a fixed location to
+// accumulate results over several runs.
+func Database(path string) Option {
+	return func(e *Extractor) (err error) {
+		e.outputOptions.db, err = filepath.Abs(path)
+		return
+	}
+}
 
-		return os.MkdirAll(e.outputOptions.dir, defaultDirPerm)
+// CaptureSource names where packets come from (a pcap file, an interface...)
+// in the sightings of the certificate store.
+func CaptureSource(name string) Option {
+	return func(e *Extractor) (err error) {
+		e.source = name
+		return
 	}
 }
 
@@ -42,6 +105,131 @@ func LogToStdout(do bool) Option {
 	}
 }
 
+// Prefilter enables classifying flows on their first payload before any
+// reassembly takes place. Flows that can't lead to a TLS handshake are dropped
+// early. Enabled by default.
+func Prefilter(do bool) Option {
+	return func(e *Extractor) (err error) {
+		e.prefilter = do
+		return nil
+	}
+}
+
+// LogFormat sets the format of the certificate log, either text (one line
+// per certificate) or jsonl (JSON Lines events, see EventSchemaVersion).
+func LogFormat(format string) Option {
+	return func(e *Extractor) (err error) {
+		switch format {
+		case logFormatText, logFormatJSONL:
+			e.outputOptions.logFormat = format
+		default:
+			return fmt.Errorf("invalid log format")
+		}
+		return
+	}
+}
+
+// Archive writes the output directory to a single archive of the given
+// format, ArchiveTarZstd or ArchiveZip, next to where the directory would
+// be. The archive is complete once Extractor.Run returns. It can't be
+// combined with Store.
+func Archive(format string) Option {
+	return func(e *Extractor) (err error) {
+		if !isArchiveFormat(format) {
+			return fmt.Errorf("invalid archive format")
+		}
+		e.outputOptions.archive = format
+		return
+	}
+}
+
+// ParquetRollover starts a new pair of parquet files once the current ones
+// have grown past maxSize bytes, roughly, or have been open for maxAge. Zero
+// disables either limit. The defaults are 256 MiB and an hour.
+func ParquetRollover(maxSize int64, maxAge time.Duration) Option {
+	return func(e *Extractor) (err error) {
+		if maxSize < 0 || maxAge < 0 {
+			return fmt.Errorf("invalid parquet rollover")
+		}
+		e.outputOptions.parquetMaxSize = maxSize
+		e.outputOptions.parquetMaxAge = maxAge
+		return
+	}
+}
+
+// Webhook POSTs the JSON Lines events, see LogFormat, to an HTTP collector in
+// batches, with the given extra headers, e.g. Authorization. Batches the
+// collector doesn't accept are spooled to disk and retried with backoff.
+func Webhook(endpoint string, header http.Header) Option {
+	return func(e *Extractor) (err error) {
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			return
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("invalid webhook url")
+		}
+		e.outputOptions.webhookURL = endpoint
+		e.outputOptions.webhookHeader = header
+		return
+	}
+}
+
+// WebhookSpool sets the directory undelivered webhook batches are spooled to,
+// webhook-spool/ next to the per run output directories by default. Batches
+// left by earlier runs are delivered first.
+func WebhookSpool(dir string) Option {
+	return func(e *Extractor) (err error) {
+		e.outputOptions.webhookSpool = dir
+		return
+	}
+}
+
+// Durable syncs files and their directories to disk as they are written, so
+// that a crash or power loss never leaves a truncated certificate behind.
+// Files are always written to a temporary name and renamed into place.
+func Durable(do bool) Option {
+	return func(e *Extractor) (err error) {
+		e.outputOptions.durable = do
+		return
+	}
+}
+
+// OnWriteFailure sets what happens when writing output fails, one of
+// WriteFailureAbort (the default), WriteFailureRetry or WriteFailureSkip.
+// An aborted run's error is returned by Extractor.Run.
+func OnWriteFailure(policy string) Option {
+	return func(e *Extractor) (err error) {
+		switch policy {
+		case WriteFailureAbort, WriteFailureRetry, WriteFailureSkip:
+			e.outputOptions.onWriteFailure = policy
+		default:
+			return fmt.Errorf("invalid write failure policy")
+		}
+		return
+	}
+}
+
+// EVEChain adds the base64 encoded certificate chain to the tls records of
+// the eve format, like Suricata's custom chain field.
+func EVEChain(do bool) Option {
+	return func(e *Extractor) (err error) {
+		e.outputOptions.eveChain = do
+		return nil
+	}
+}
+
+// PrintFlow prints the certificates of a single flow to w in the text format.
+// The flow is selected by its index, its hash or the server's ip:port, as
+// found in the certificate log.
+func PrintFlow(flow string, w io.Writer) Option {
+	return func(e *Extractor) (err error) {
+		e.outputOptions.printFlow = flow
+		e.outputOptions.printTo = w
+		return nil
+	}
+}
+
 func EnableOutputFormat(format string, do bool) Option {
 	return func(e *Extractor) (err error) {
 		switch format {
@@ -51,9 +239,72 @@ func EnableOutputFormat(format string, do bool) Option {
 			e.outputOptions.der = do
 		case "pem":
 			e.outputOptions.pem = do
+		case "text":
+			e.outputOptions.text = do
+		case "chain":
+			e.outputOptions.chain = do
+		case "sqlite":
+			e.outputOptions.sqlite = do
+		case "zeek":
+			e.outputOptions.zeek = do
+		case "zeek-json":
+			e.outputOptions.zeekJSON = do
+		case "eve":
+			e.outputOptions.eve = do
+		case "parquet":
+			e.outputOptions.parquet = do
+		case "stix":
+			e.outputOptions.stix = do
 		default:
 			return fmt.Errorf("invalid format")
 		}
 		return
 	}
 }
+
+// Sinks registers sinks receiving every extracted chain, after the built-in
+// outputs. Sinks are closed when Run returns.
+func Sinks(sinks ...Sink) Option {
+	return func(e *Extractor) (err error) {
+		for _, s := range sinks {
+			if s == nil {
+				return fmt.Errorf("nil sink")
+			}
+		}
+		e.outputOptions.sinks = append(e.outputOptions.sinks, sinks...)
+		return
+	}
+}
+
+// CaptureFilter applies a BPF filter to the packet source when Run starts.
+// The source must implement FilterSource.
+func CaptureFilter(bpf string) Option {
+	return func(e *Extractor) (err error) {
+		e.bpf = bpf
+		return
+	}
+}
+
+// HandshakePattern sets the regular expression the first bytes of a stream
+// must match to be parsed as a TLS handshake. The default matches a
+// handshake record of SSL 3.0 up to TLS 1.2.
+func HandshakePattern(expr string) Option {
+	return func(e *Extractor) (err error) {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return fmt.Errorf("invalid handshake pattern: %w", err)
+		}
+		e.handshake.regex = re
+		return
+	}
+}
+
+// FailureLog writes a JSON line per stream no certificate chain was extracted
+// from to failures.jsonl in the output directory: where it was seen, the
+// reason, as counted in Summary.Failures, and the error.
+func FailureLog(do bool) Option {
+	return func(e *Extractor) (err error) {
+		e.outputOptions.failureLog = do
+		return
+	}
+}
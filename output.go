@@ -1,150 +1,451 @@
 package certgrep
 
 import (
+	"context"
 	"crypto/sha1"
-	"crypto/x509"
+	"crypto/sha256"
 	"encoding/hex"
-	"encoding/json"
-	"encoding/pem"
 	"fmt"
 	"io"
-	"io/ioutil"
-	"log"
+	"net/http"
 	"os"
-	"path"
 	"path/filepath"
 	"time"
+
+	"go.uber.org/zap"
 )
 
 type output struct {
-	persist     chan *ctx
+	*writePolicy
+	persist     chan Observation
+	failed      chan FlowResult
 	done        chan struct{}
-	certLogFile io.WriteCloser
+	certLogFile *os.File
 	options     outputOptions
+	store       *store
+	fs          fileSystem
+	// nil unless enabled
+	failureLog *failureLog
+	// built-in sinks first, then those of the library user
+	sinks []Sink
+	// passed to the sinks
+	ctx    context.Context
+	logger *zap.SugaredLogger
+	// the error that stopped output, nil while running
+	err error
+	// receives err once it is set, for the packet loop to stop
+	aborted chan error
+	// chains received
+	chains uint64
+}
+
+// writePolicy applies the write failure policy, shared by the output and
+// the sinks writing files.
+type writePolicy struct {
+	onFailure string
+	logger    *zap.SugaredLogger
+	// writes given up under WriteFailureSkip
+	failures uint64
 }
 
 type outputOptions struct {
-	der  bool
-	json bool
-	pem  bool
-	dir  string
+	der           bool
+	json          bool
+	pem           bool
+	text          bool
+	chain         bool
+	sqlite        bool
+	zeek          bool
+	zeekJSON      bool
+	eve           bool
+	eveChain      bool
+	parquet       bool
+	stix          bool
+	failureLog    bool
+	printFlow     string
+	layout        string
+	datePartition bool
+	index         bool
+	printTo       io.Writer
+	dir           string
+	store         string
+	db            string
+	logFormat     string
+	// sync files to disk before renaming them into place
+	durable        bool
+	onWriteFailure string
+	// write the output directory to an archive of this format instead
+	archive string
+	// start new parquet files past this size or age, 0 for never
+	parquetMaxSize int64
+	parquetMaxAge  time.Duration
+	// the wall clock, for processing times and Zeek's #open and #close
+	now func() time.Time
+	// POST events to this URL
+	webhookURL    string
+	webhookHeader http.Header
+	webhookSpool  string
+	// registered by the library user
+	sinks []Sink
+}
+
+const (
+	logFormatText  = "text"
+	logFormatJSONL = "jsonl"
+)
+
+// Policies for failed writes, see OnWriteFailure.
+const (
+	// stop writing and return the error from Extractor.Run
+	WriteFailureAbort = "abort"
+	// retry writes of whole files a few times, then abort
+	WriteFailureRetry = "retry"
+	// log and count the failure, carry on with the next write
+	WriteFailureSkip = "skip"
+)
+
+const (
+	writeRetries   = 3
+	writeRetryWait = 100 * time.Millisecond
+)
+
+// files reports whether any per certificate file format is enabled.
+func (o outputOptions) files() bool {
+	return o.der || o.json || o.pem || o.text
+}
+
+// usesDir reports whether anything will be written to the output directory.
+func (o outputOptions) usesDir(logToStdout bool) bool {
+	return !logToStdout || (o.files() && o.store == "") || (o.sqlite && o.db == "") ||
+		o.zeek || o.zeekJSON || o.eve || o.parquet || o.stix || o.failureLog ||
+		(o.chain && o.store == "")
 }
 
-type ctx struct {
-	certs   []*x509.Certificate
-	logLine string
-	/*
-		src      gopacket.Endpoint
-		dst      gopacket.Endpoint
-		flowId   uint64
-		flowHash string
-	*/
+// archivePath returns where the archive standing in for the output directory
+// is written, next to it.
+func (o outputOptions) archivePath() string {
+	return o.dir + "." + o.archive
 }
 
-func newOutput(logfile string, options outputOptions) (*output, error) {
+const outputFlushInterval = time.Second
+
+// newOutput starts the output goroutine. The certificate log is written to
+// logfile in the output directory, or to stdout if logfile is "-".
+func newOutput(logfile string, options outputOptions, logger *zap.SugaredLogger) (*output, error) {
 	var (
 		err error
 		clf *os.File
 	)
-	if logLine == "-" {
+	var fs fileSystem = diskFS{durable: options.durable}
+	// nothing touches the file system unless something has to be written
+	if options.dir != "" && options.usesDir(logfile == "-") {
+		if options.archive != "" {
+			if options.store != "" {
+				return nil, fmt.Errorf("the certificate store can't be written to an archive")
+			}
+			fs, err = newArchiveFS(options.archive, options.archivePath(),
+				filepath.Dir(options.dir), options.durable)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if err = fs.mkdirAll(options.dir); err != nil {
+			return nil, err
+		}
+	}
+	if logfile == "-" {
 		clf = os.Stdout
 	} else {
-		clf, err = os.Create(path.Join(options.dir, logfile))
+		clf, err = createFile(fs, filepath.Join(options.dir, logfile))
 		if err != nil {
 			return nil, err
 		}
 	}
 	o := &output{
-		persist:     make(chan *ctx),
+		writePolicy: &writePolicy{onFailure: options.onWriteFailure, logger: logger},
+		persist:     make(chan Observation),
+		failed:      make(chan FlowResult),
+		aborted:     make(chan error, 1),
 		done:        make(chan struct{}),
 		certLogFile: clf,
 		options:     options,
+		fs:          fs,
+		ctx:         context.Background(),
+		logger:      logger,
+	}
+	if options.store != "" {
+		o.store, err = newStore(options.store, options.durable)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if options.failureLog {
+		o.failureLog, err = newFailureLog(fs, options.dir, options.durable)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var files *fileSink
+	if options.files() || o.store != nil {
+		// first, other sinks may refer to the files
+		files = newFileSink(options, fs, o.store, o.writePolicy)
+		o.sinks = append(o.sinks, files)
+	}
+	if options.sqlite {
+		db := options.db
+		if db == "" {
+			db, err = fs.local(filepath.Join(options.dir, "certgrep.db"))
+			if err != nil {
+				return nil, err
+			}
+		}
+		w, err := newSQLiteWriter(db)
+		if err != nil {
+			return nil, err
+		}
+		o.sinks = append(o.sinks, w)
+	}
+	for _, asJSON := range []bool{false, true} {
+		if (asJSON && !options.zeekJSON) || (!asJSON && !options.zeek) {
+			continue
+		}
+		w, err := newZeekWriter(fs, options.dir, asJSON, options.durable, options.now)
+		if err != nil {
+			return nil, err
+		}
+		o.sinks = append(o.sinks, w)
 	}
+	if options.chain {
+		w := &bundleWriter{
+			dir:     options.dir,
+			fs:      fs,
+			written: make(map[string]bool),
+		}
+		if o.store != nil {
+			w.dir = o.store.dir
+			w.nested = true
+		}
+		if options.files() {
+			w.certDir = files.certDir
+		}
+		o.sinks = append(o.sinks, w)
+	}
+	if options.printFlow != "" {
+		o.sinks = append(o.sinks, &textWriter{flow: options.printFlow, w: options.printTo})
+	}
+	if options.eve {
+		w, err := newEveWriter(fs, options.dir, options.eveChain, options.durable)
+		if err != nil {
+			return nil, err
+		}
+		o.sinks = append(o.sinks, w)
+	}
+	if options.parquet {
+		o.sinks = append(o.sinks, &parquetWriter{
+			fs:      fs,
+			dir:     options.dir,
+			durable: options.durable,
+			maxSize: options.parquetMaxSize,
+			maxAge:  options.parquetMaxAge,
+		})
+	}
+	if options.webhookURL != "" {
+		spool := options.webhookSpool
+		if spool == "" {
+			// shared by runs, so that later ones deliver what is left
+			spool = filepath.Join(filepath.Dir(options.dir), "webhook-spool")
+		}
+		w, err := newWebhookWriter(options.webhookURL, options.webhookHeader, spool,
+			logger.Named("webhook"))
+		if err != nil {
+			return nil, err
+		}
+		o.sinks = append(o.sinks, w)
+	}
+	if options.stix {
+		o.sinks = append(o.sinks, newSTIXWriter(fs, options.dir))
+	}
+	o.sinks = append(o.sinks, options.sinks...)
 	go o.run()
 	return o, nil
 }
 
-func (o *output) PersistCertificate(certs []*x509.Certificate,
-	logLine string) {
-	o.persist <- &ctx{
-		certs:   certs,
-		logLine: logLine,
-	}
+// Observe queues a chain for the output goroutine.
+func (o *output) Observe(_ context.Context, obs Observation) error {
+	o.persist <- obs
+	return nil
 }
 
 func (o *output) run() {
-	for ctx := range o.persist {
-		for i, cert := range ctx.certs {
-			h := sha1.New()
-			h.Write(cert.Raw)
-			digest := hex.EncodeToString(h.Sum(nil))
+	flush := time.NewTicker(outputFlushInterval)
+	defer flush.Stop()
 
-			path := filepath.Join(o.options.dir, digest)
+	for {
+		select {
+		case obs, ok := <-o.persist:
+			if !ok {
+				goto done
+			}
+			o.chains++
+			// once aborted, chains are still received so that stream
+			// handlers don't block, but dropped
+			if o.err == nil {
+				o.abort(o.write(obs))
+			}
+		case result := <-o.failed:
+			if o.err == nil {
+				o.abort(o.fail(o.failureLog.write(result)))
+			}
+		case <-flush.C:
+			if o.err == nil {
+				o.abort(o.flush())
+			}
+		}
+	}
 
-			// TODO: break if cert already written
+done:
+	for _, s := range o.sinks {
+		if err := o.fail(s.Close()); err != nil && o.err == nil {
+			o.err = err
+		}
+	}
+	if o.certLogFile != os.Stdout {
+		if err := o.fail(o.closeLog()); err != nil && o.err == nil {
+			o.err = err
+		}
+	}
+	if o.failureLog != nil {
+		if err := o.fail(o.failureLog.close()); err != nil && o.err == nil {
+			o.err = err
+		}
+	}
+	// last, an archive takes in the files closed above
+	if err := o.fail(o.fs.close()); err != nil && o.err == nil {
+		o.err = err
+	}
+	close(o.done)
+}
 
-			if err := os.MkdirAll(path, defaultDirPerm); err != nil {
-				log.Fatal(err)
-			}
+// abort stops writing on err, if not nil, and tells the packet loop through
+// aborted.
+func (o *output) abort(err error) {
+	if err == nil {
+		return
+	}
+	o.err = err
+	o.logger.Errorf("writing output failed, stopping: %v", err)
+	o.aborted <- err
+}
 
-			// log.Printf("%d %s %s", i, digest, cert.Subject.CommonName)
-			// log.Print(cert.Verify(x509.VerifyOptions{}))
+func (o *output) flush() error {
+	for _, s := range o.sinks {
+		f, ok := s.(flusher)
+		if !ok {
+			continue
+		}
+		if err := o.fail(f.flush()); err != nil {
+			return err
+		}
+	}
+	if o.failureLog != nil {
+		if err := o.fail(o.failureLog.flush()); err != nil {
+			return err
+		}
+	}
+	if o.options.durable && o.certLogFile != os.Stdout {
+		return o.fail(o.certLogFile.Sync())
+	}
+	return nil
+}
 
-			//if !cert.IsCA {
-			//log.Print(cert.CheckSignatureFrom(cert))
-			//}
+func (o *output) closeLog() error {
+	if o.options.durable {
+		if err := o.certLogFile.Sync(); err != nil {
+			o.certLogFile.Close()
+			return err
+		}
+	}
+	return o.certLogFile.Close()
+}
 
-			if o.options.der {
-				ioutil.WriteFile(filepath.Join(path, "cert.der"), cert.Raw, 0644)
-			}
+// fail applies the write failure policy to err. It returns an error only if
+// output has to stop.
+func (p *writePolicy) fail(err error) error {
+	if err == nil || p.onFailure != WriteFailureSkip {
+		return err
+	}
+	p.failures++
+	p.logger.Warnf("write failed, skipping: %v", err)
+	return nil
+}
 
-			if o.options.pem {
-				func() {
-					block := pem.Block{
-						Type:  "CERTIFICATE",
-						Bytes: cert.Raw,
-					}
-
-					out, err := os.Create(filepath.Join(path, "cert.pem"))
-					if err != nil {
-						log.Fatal(err)
-					}
-					defer out.Close()
-
-					err = pem.Encode(out, &block)
-					if err != nil {
-						log.Fatal(err)
-					}
-				}()
-			}
+// try runs a write that can be repeated safely, like writing a whole file,
+// retrying it if the policy says so.
+func (p *writePolicy) try(write func() error) error {
+	err := write()
+	if p.onFailure == WriteFailureRetry {
+		wait := writeRetryWait
+		for i := 0; err != nil && i < writeRetries; i++ {
+			p.logger.Warnf("write failed, retrying in %s: %v", wait, err)
+			time.Sleep(wait)
+			wait *= 2
+			err = write()
+		}
+	}
+	return p.fail(err)
+}
 
-			// Note: cert.Verify requires cert.Raw
-			cert.Raw = nil
-			cert.RawIssuer = nil
-			cert.RawSubject = nil
-			cert.RawSubjectPublicKeyInfo = nil
-			cert.RawTBSCertificate = nil
-
-			if o.options.json {
-				raw, err := json.MarshalIndent(cert, "", "  ")
-				if err != nil {
-					log.Fatal(err)
-				}
-				ioutil.WriteFile(filepath.Join(path, "cert.json"), raw, 0644)
+func (o *output) write(obs Observation) error {
+	if o.options.logFormat == logFormatJSONL {
+		if err := o.fail(writeEvents(o.certLogFile, obs)); err != nil {
+			return err
+		}
+	} else {
+		prefix := obs.logPrefix()
+		for i, cert := range obs.Chain {
+			sum1 := sha1.Sum(cert.Raw)
+			sum256 := sha256.Sum256(cert.Raw)
+			// quoted, a common name can hold spaces, quotes and newlines
+			_, err := fmt.Fprintf(o.certLogFile,
+				"%s %s cert:%d cn:%q fingerprint:%s serial:%s start:%s handshake:%s processed:%s sha256:%s\n",
+				formatTime(obs.seen()), prefix,
+				i, cert.Subject.CommonName, hex.EncodeToString(sum1[:]), cert.SerialNumber.String(),
+				formatTime(obs.ConnectionStart),
+				formatTime(obs.HandshakeComplete),
+				formatTime(obs.Processed),
+				hex.EncodeToString(sum256[:]))
+			if err = o.fail(err); err != nil {
+				return err
 			}
+		}
+	}
 
-			// TODO(jca): proper escaping
-			fmt.Fprintf(o.certLogFile,
-				"%s %s cert:%d cn:\"%s\" fingerprint:%s serial:%s\n",
-				time.Now().UTC().Format(time.RFC3339), ctx.logLine,
-				i, cert.Subject.CommonName, digest, cert.SerialNumber.String())
+	for _, s := range o.sinks {
+		if err := o.fail(s.Observe(o.ctx, obs)); err != nil {
+			return err
 		}
 	}
-	close(o.done)
+	return nil
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+// logFailure queues a stream no chain was extracted from for the failure
+// log, if enabled.
+func (o *output) logFailure(result FlowResult) {
+	if o.failureLog != nil {
+		o.failed <- result
+	}
 }
 
-func (o *output) WaitUntilDone() {
+// Close drains the output and returns the error that stopped it, if any.
+func (o *output) Close() error {
 	close(o.persist)
 	<-o.done
-	o.certLogFile.Close()
+	return o.err
 }
@@ -0,0 +1,42 @@
+package certgrep
+
+import (
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOutputCertificateLog(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "certificates.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	o := &output{writePolicy: &writePolicy{}, certLogFile: f}
+
+	cn := "evil\" fingerprint:0000\nforged line\\"
+	obs := Observation{
+		Server:          "10.0.0.2:443",
+		Client:          "10.0.0.1:51000",
+		CertificateSeen: time.Date(2015, 4, 3, 7, 49, 20, 0, time.UTC),
+		Chain:           []*x509.Certificate{selfSigned(t, cn, time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC))},
+	}
+	if err = o.write(obs); err != nil {
+		t.Fatal(err)
+	}
+	log, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(log), "\n"), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("%d lines logged, want 1:\n%s", len(lines), log)
+	}
+	if want := ` cn:"evil\" fingerprint:0000\nforged line\\" fingerprint:`; !strings.Contains(lines[0], want) {
+		t.Errorf("logged %s, want it to contain %s", lines[0], want)
+	}
+}
@@ -0,0 +1,279 @@
+package certgrep
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+const (
+	// buffered rows are written out as a row group once this large
+	parquetRowGroupSize = 32 * 1024 * 1024
+	// rollover defaults, see ParquetRollover
+	defaultParquetMaxSize = 256 * 1024 * 1024
+	defaultParquetMaxAge  = time.Hour
+)
+
+// parquetObservation is a row of observations-NNNN.parquet, a TLS handshake
+// and the chain the server sent.
+type parquetObservation struct {
+	Timestamp         int64   `parquet:"name=ts, type=INT64, convertedtype=TIMESTAMP_MICROS"`
+	ConnectionStart   *int64  `parquet:"name=connection_start, type=INT64, convertedtype=TIMESTAMP_MICROS, repetitiontype=OPTIONAL"`
+	HandshakeComplete *int64  `parquet:"name=handshake_complete, type=INT64, convertedtype=TIMESTAMP_MICROS, repetitiontype=OPTIONAL"`
+	UID               string  `parquet:"name=uid, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Source            string  `parquet:"name=source, type=BYTE_ARRAY, convertedtype=UTF8"`
+	FlowIndex         int64   `parquet:"name=flow_index, type=INT64"`
+	FlowHash          string  `parquet:"name=flow_hash, type=BYTE_ARRAY, convertedtype=UTF8"`
+	ClientIP          string  `parquet:"name=client_ip, type=BYTE_ARRAY, convertedtype=UTF8"`
+	ClientPort        int32   `parquet:"name=client_port, type=INT32"`
+	ServerIP          string  `parquet:"name=server_ip, type=BYTE_ARRAY, convertedtype=UTF8"`
+	ServerPort        int32   `parquet:"name=server_port, type=INT32"`
+	ServerName        *string `parquet:"name=server_name, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=OPTIONAL"`
+	Version           string  `parquet:"name=version, type=BYTE_ARRAY, convertedtype=UTF8"`
+	CipherSuite       string  `parquet:"name=cipher_suite, type=BYTE_ARRAY, convertedtype=UTF8"`
+	JA3               *string `parquet:"name=ja3, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=OPTIONAL"`
+	JA3S              *string `parquet:"name=ja3s, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=OPTIONAL"`
+	ChainHash         string  `parquet:"name=chain_hash, type=BYTE_ARRAY, convertedtype=UTF8"`
+	// SHA-256 digests, leaf first
+	Chain []string `parquet:"name=chain_sha256, type=LIST, valuetype=BYTE_ARRAY, valueconvertedtype=UTF8"`
+}
+
+// parquetCertificate is a row of certificates-NNNN.parquet. Every certificate
+// referred to by the observations of a file is in the certificates file of
+// the same number, once.
+type parquetCertificate struct {
+	SHA256             string   `parquet:"name=sha256, type=BYTE_ARRAY, convertedtype=UTF8"`
+	SHA1               string   `parquet:"name=sha1, type=BYTE_ARRAY, convertedtype=UTF8"`
+	SPKISHA256         string   `parquet:"name=spki_sha256, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Subject            string   `parquet:"name=subject, type=BYTE_ARRAY, convertedtype=UTF8"`
+	SubjectCN          string   `parquet:"name=subject_cn, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Issuer             string   `parquet:"name=issuer, type=BYTE_ARRAY, convertedtype=UTF8"`
+	IssuerCN           string   `parquet:"name=issuer_cn, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Serial             string   `parquet:"name=serial, type=BYTE_ARRAY, convertedtype=UTF8"`
+	NotBefore          int64    `parquet:"name=not_before, type=INT64, convertedtype=TIMESTAMP_MILLIS"`
+	NotAfter           int64    `parquet:"name=not_after, type=INT64, convertedtype=TIMESTAMP_MILLIS"`
+	IsCA               bool     `parquet:"name=is_ca, type=BOOLEAN"`
+	KeyAlgorithm       string   `parquet:"name=key_algorithm, type=BYTE_ARRAY, convertedtype=UTF8"`
+	KeySize            int32    `parquet:"name=key_size, type=INT32"`
+	KeyCurve           *string  `parquet:"name=key_curve, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=OPTIONAL"`
+	SignatureAlgorithm string   `parquet:"name=signature_algorithm, type=BYTE_ARRAY, convertedtype=UTF8"`
+	DNSNames           []string `parquet:"name=san_dns, type=LIST, valuetype=BYTE_ARRAY, valueconvertedtype=UTF8"`
+	IPAddresses        []string `parquet:"name=san_ip, type=LIST, valuetype=BYTE_ARRAY, valueconvertedtype=UTF8"`
+	EmailAddresses     []string `parquet:"name=san_email, type=LIST, valuetype=BYTE_ARRAY, valueconvertedtype=UTF8"`
+	URIs               []string `parquet:"name=san_uri, type=LIST, valuetype=BYTE_ARRAY, valueconvertedtype=UTF8"`
+	FirstSeen          int64    `parquet:"name=first_seen, type=INT64, convertedtype=TIMESTAMP_MICROS"`
+	DER                string   `parquet:"name=der, type=BYTE_ARRAY"`
+}
+
+// parquetFile is a Parquet file being written.
+type parquetFile struct {
+	f  *os.File
+	pw *writer.ParquetWriter
+}
+
+func newParquetFile(fs fileSystem, path string, schema interface{}) (*parquetFile, error) {
+	f, err := createFile(fs, path)
+	if err != nil {
+		return nil, err
+	}
+	pw, err := writer.NewParquetWriterFromWriter(f, schema, 1)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	pw.RowGroupSize = parquetRowGroupSize
+	pw.CompressionType = parquet.CompressionCodec_SNAPPY
+	return &parquetFile{f: f, pw: pw}, nil
+}
+
+// size estimates the size of the file once the buffered rows are written.
+func (p *parquetFile) size() int64 {
+	return p.pw.Offset + p.pw.Size + p.pw.ObjsSize
+}
+
+// close writes the buffered rows and the footer.
+func (p *parquetFile) close(durable bool) error {
+	err := p.pw.WriteStop()
+	if err == nil && durable {
+		err = p.f.Sync()
+	}
+	if cerr := p.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// parquetWriter writes observations and certificates to pairs of Parquet
+// files for loading into DuckDB, Spark and the like. A new pair is started
+// once the files grow past maxSize or have been open for maxAge, a file only
+// has a footer, and is readable, once it has been rolled over or the output
+// is closed.
+type parquetWriter struct {
+	fs      fileSystem
+	dir     string
+	durable bool
+	maxSize int64
+	maxAge  time.Duration
+
+	// number of the current pair, starting at 1
+	seq          int
+	started      time.Time
+	observations *parquetFile
+	certificates *parquetFile
+	// certificates written to the current pair
+	written map[string]bool
+}
+
+func (w *parquetWriter) open() (err error) {
+	w.seq++
+	w.observations, err = newParquetFile(w.fs,
+		filepath.Join(w.dir, fmt.Sprintf("observations-%04d.parquet", w.seq)), new(parquetObservation))
+	if err != nil {
+		return err
+	}
+	w.certificates, err = newParquetFile(w.fs,
+		filepath.Join(w.dir, fmt.Sprintf("certificates-%04d.parquet", w.seq)), new(parquetCertificate))
+	if err != nil {
+		w.observations.close(false)
+		w.observations = nil
+		return err
+	}
+	w.started = time.Now()
+	w.written = make(map[string]bool)
+	return nil
+}
+
+func (w *parquetWriter) Observe(_ context.Context, obs Observation) error {
+	if len(obs.Chain) == 0 {
+		return nil
+	}
+	if w.observations == nil {
+		if err := w.open(); err != nil {
+			return err
+		}
+	}
+
+	seen := obs.seen()
+	clientIP, clientPort := splitHostPort(obs.Client)
+	serverIP, serverPort := splitHostPort(obs.Server)
+	row := &parquetObservation{
+		Timestamp:         seen.UnixMicro(),
+		ConnectionStart:   parquetTime(obs.ConnectionStart),
+		HandshakeComplete: parquetTime(obs.HandshakeComplete),
+		UID:               connectionUID(obs),
+		Source:            obs.Source,
+		FlowIndex:         int64(obs.FlowIndex),
+		FlowHash:          obs.FlowHash,
+		ClientIP:          clientIP,
+		ClientPort:        int32(clientPort),
+		ServerIP:          serverIP,
+		ServerPort:        int32(serverPort),
+		ServerName:        parquetString(obs.ServerName),
+		Version:           versionName(obs.Version),
+		CipherSuite:       cipherSuiteName(obs.CipherSuite),
+		ChainHash:         chainHash(obs.Chain),
+		Chain:             make([]string, len(obs.Chain)),
+	}
+	if obs.JA3 != "" {
+		row.JA3 = parquetString(ja3Hash(obs.JA3))
+	}
+	if obs.JA3S != "" {
+		row.JA3S = parquetString(ja3Hash(obs.JA3S))
+	}
+
+	for i, cert := range obs.Chain {
+		sum := sha256.Sum256(cert.Raw)
+		digest := hex.EncodeToString(sum[:])
+		row.Chain[i] = digest
+		if w.written[digest] {
+			continue
+		}
+		if err := w.certificates.pw.Write(newParquetCertificate(cert, seen)); err != nil {
+			return err
+		}
+		w.written[digest] = true
+	}
+	if err := w.observations.pw.Write(row); err != nil {
+		return err
+	}
+
+	if w.maxSize > 0 && w.observations.size()+w.certificates.size() >= w.maxSize {
+		return w.rollover()
+	}
+	return nil
+}
+
+func newParquetCertificate(cert *x509.Certificate, seen time.Time) *parquetCertificate {
+	c := NewCertificate(cert)
+	return &parquetCertificate{
+		SHA256:             c.Fingerprints.SHA256,
+		SHA1:               c.Fingerprints.SHA1,
+		SPKISHA256:         c.Fingerprints.SPKISHA256,
+		Subject:            cert.Subject.String(),
+		SubjectCN:          cert.Subject.CommonName,
+		Issuer:             cert.Issuer.String(),
+		IssuerCN:           cert.Issuer.CommonName,
+		Serial:             c.SerialNumberHex,
+		NotBefore:          cert.NotBefore.UnixMilli(),
+		NotAfter:           cert.NotAfter.UnixMilli(),
+		IsCA:               cert.IsCA,
+		KeyAlgorithm:       c.PublicKey.Algorithm,
+		KeySize:            int32(c.PublicKey.Size),
+		KeyCurve:           parquetString(c.PublicKey.Curve),
+		SignatureAlgorithm: c.SignatureAlgorithm,
+		DNSNames:           c.SubjectAltNames.DNSNames,
+		IPAddresses:        c.SubjectAltNames.IPAddresses,
+		EmailAddresses:     c.SubjectAltNames.EmailAddresses,
+		URIs:               c.SubjectAltNames.URIs,
+		FirstSeen:          seen.UnixMicro(),
+		DER:                string(cert.Raw),
+	}
+}
+
+// rollover finishes the current pair, the next one is started by the next
+// chain.
+func (w *parquetWriter) rollover() error {
+	if w.observations == nil {
+		return nil
+	}
+	err := w.observations.close(w.durable)
+	if cerr := w.certificates.close(w.durable); err == nil {
+		err = cerr
+	}
+	w.observations, w.certificates = nil, nil
+	return err
+}
+
+func (w *parquetWriter) flush() error {
+	if w.maxAge > 0 && w.observations != nil && time.Since(w.started) >= w.maxAge {
+		return w.rollover()
+	}
+	return nil
+}
+
+func (w *parquetWriter) Close() error {
+	return w.rollover()
+}
+
+func parquetTime(t time.Time) *int64 {
+	if t.IsZero() {
+		return nil
+	}
+	us := t.UnixMicro()
+	return &us
+}
+
+func parquetString(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
@@ -0,0 +1,188 @@
+package certgrep
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/reader"
+)
+
+// selfSigned returns a throwaway certificate valid until notAfter.
+func selfSigned(t *testing.T, cn string, notAfter time.Time) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     []string{cn},
+		NotBefore:    time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// openParquet opens a Parquet file of rows like row.
+func openParquet(t *testing.T, path string, row interface{}) *reader.ParquetReader {
+	t.Helper()
+	f, err := local.NewLocalFileReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	pr, err := reader.NewParquetReader(f, row, 1)
+	if err != nil {
+		t.Fatalf("%s: %v", path, err)
+	}
+	t.Cleanup(pr.ReadStop)
+	return pr
+}
+
+// readPair reads the observations and certificates of the seq-th pair of
+// files in dir.
+func readPair(t *testing.T, dir string, seq int) ([]parquetObservation, []parquetCertificate) {
+	t.Helper()
+	pr := openParquet(t, filepath.Join(dir, fmt.Sprintf("observations-%04d.parquet", seq)), new(parquetObservation))
+	observations := make([]parquetObservation, pr.GetNumRows())
+	if err := pr.Read(&observations); err != nil {
+		t.Fatal(err)
+	}
+	pr = openParquet(t, filepath.Join(dir, fmt.Sprintf("certificates-%04d.parquet", seq)), new(parquetCertificate))
+	certificates := make([]parquetCertificate, pr.GetNumRows())
+	if err := pr.Read(&certificates); err != nil {
+		t.Fatal(err)
+	}
+	return observations, certificates
+}
+
+func TestParquetWriter(t *testing.T) {
+	dir := t.TempDir()
+	w := &parquetWriter{fs: diskFS{}, dir: dir}
+
+	seen := time.Date(2015, 4, 3, 7, 49, 20, 123456000, time.UTC)
+	// past the year 2262, nanoseconds since the epoch overflow an int64
+	notAfter := time.Date(9999, 12, 31, 23, 59, 59, 0, time.UTC)
+	longLived := Observation{
+		Server:          "10.0.0.3:443",
+		Client:          "10.0.0.1:51001",
+		CertificateSeen: seen,
+		Chain:           []*x509.Certificate{selfSigned(t, "forever.example.com", notAfter)},
+	}
+	obs := stream1Observation(t)
+	obs.CertificateSeen = seen
+	for _, o := range []Observation{obs, longLived, obs} {
+		if err := w.Observe(context.Background(), o); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	observations, certificates := readPair(t, dir, 1)
+	if len(observations) != 3 {
+		t.Fatalf("%d observations, want 3", len(observations))
+	}
+	// a certificate is written once per pair of files
+	if len(certificates) != 2 {
+		t.Fatalf("%d certificates, want 2", len(certificates))
+	}
+	o := observations[1]
+	if o.Timestamp != seen.UnixMicro() || o.ServerIP != "10.0.0.3" || o.ServerPort != 443 ||
+		o.ClientPort != 51001 || o.ServerName != nil || len(o.Chain) != 1 {
+		t.Errorf("observation %+v", o)
+	}
+	c := certificates[1]
+	if c.SubjectCN != "forever.example.com" || c.Serial != "1" {
+		t.Errorf("certificate %+v", c)
+	}
+	if got := time.UnixMilli(c.NotAfter).UTC(); !got.Equal(notAfter) {
+		t.Errorf("not after %s, want %s", got, notAfter)
+	}
+	if got := time.UnixMilli(c.NotBefore).UTC(); !got.Equal(longLived.Chain[0].NotBefore) {
+		t.Errorf("not before %s", got)
+	}
+	if c.DER != string(longLived.Chain[0].Raw) || c.FirstSeen != seen.UnixMicro() {
+		t.Errorf("DER or first seen not written")
+	}
+}
+
+func TestParquetWriterRollover(t *testing.T) {
+	obs := stream1Observation(t)
+
+	t.Run("size", func(t *testing.T) {
+		dir := t.TempDir()
+		// every chain fills a pair of files
+		w := &parquetWriter{fs: diskFS{}, dir: dir, maxSize: 1}
+		for i := 0; i < 3; i++ {
+			if err := w.Observe(context.Background(), obs); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		for seq := 1; seq <= 3; seq++ {
+			observations, certificates := readPair(t, dir, seq)
+			if len(observations) != 1 || len(certificates) != 1 {
+				t.Errorf("pair %d: %d observations and %d certificates, want 1 and 1",
+					seq, len(observations), len(certificates))
+			}
+		}
+		if files, _ := filepath.Glob(filepath.Join(dir, "*.parquet")); len(files) != 6 {
+			t.Errorf("%d files, want 6", len(files))
+		}
+	})
+
+	t.Run("age", func(t *testing.T) {
+		dir := t.TempDir()
+		w := &parquetWriter{fs: diskFS{}, dir: dir, maxAge: time.Hour}
+		observe := func() {
+			if err := w.Observe(context.Background(), obs); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.flush(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		observe()
+		observe()
+		// the first pair has been open for long enough
+		w.started = w.started.Add(-time.Hour)
+		if err := w.flush(); err != nil {
+			t.Fatal(err)
+		}
+		// readable before Close
+		if observations, _ := readPair(t, dir, 1); len(observations) != 2 {
+			t.Errorf("%d observations in the first pair, want 2", len(observations))
+		}
+		observe()
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if observations, certificates := readPair(t, dir, 2); len(observations) != 1 || len(certificates) != 1 {
+			t.Errorf("%d observations and %d certificates in the second pair, want 1 and 1",
+				len(observations), len(certificates))
+		}
+	})
+}
@@ -0,0 +1,112 @@
+// Package pcapsource reads packets for a certgrep.Extractor from libpcap, a
+// live capture or a capture file.
+package pcapsource
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"runtime"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/pcap"
+	"github.com/kung-foo/certgrep"
+	"github.com/olekukonko/tablewriter"
+	"go.uber.org/zap"
+)
+
+// Source adapts a pcap handle to certgrep.PacketSource, with statistics.
+type Source struct {
+	*pcap.Handle
+}
+
+var _ certgrep.StatsSource = (*Source)(nil)
+
+// New wraps an open handle.
+func New(handle *pcap.Handle) *Source {
+	return &Source{Handle: handle}
+}
+
+// OpenOffline opens a pcap or pcapng file.
+func OpenOffline(path string) (*Source, error) {
+	handle, err := pcap.OpenOffline(path)
+	if err != nil {
+		return nil, err
+	}
+	return New(handle), nil
+}
+
+// OpenLive captures on a network interface.
+func OpenLive(device string, snaplen int32, promisc bool) (*Source, error) {
+	handle, err := pcap.OpenLive(device, snaplen, promisc, pcap.BlockForever)
+	if err != nil {
+		return nil, err
+	}
+	return New(handle), nil
+}
+
+// ReadPacketData reads the next packet, waiting for one if the handle was
+// opened with a read timeout.
+func (s *Source) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	for {
+		data, ci, err := s.Handle.ReadPacketData()
+		if err != pcap.NextErrorTimeoutExpired {
+			return data, ci, err
+		}
+	}
+}
+
+// Stats returns the statistics of a live capture.
+func (s *Source) Stats() (certgrep.PacketStats, error) {
+	stats, err := s.Handle.Stats()
+	if err != nil {
+		return certgrep.PacketStats{}, err
+	}
+	return certgrep.PacketStats{
+		PacketsReceived:  stats.PacketsReceived,
+		PacketsDropped:   stats.PacketsDropped,
+		PacketsIfDropped: stats.PacketsIfDropped,
+	}, nil
+}
+
+// PrintDeviceTable lists the interfaces libpcap can capture on.
+func PrintDeviceTable(out io.Writer, logger *zap.SugaredLogger) error {
+	if runtime.GOOS == "linux" {
+		if os.Geteuid() != 0 {
+			logger.Info("Not all capture devices may be visible with your current user.")
+		}
+	}
+
+	ifs, err := pcap.FindAllDevs()
+	if err != nil {
+		return err
+	}
+
+	if len(ifs) == 0 {
+		me, _ := user.Current()
+		return fmt.Errorf("No devices found. Does user \"%s\" have access?", me.Name)
+	}
+	tbl := tablewriter.NewWriter(out)
+	tbl.SetHeader([]string{"name", "addresses", "description"})
+	tbl.SetRowLine(true)
+
+	for _, dev := range ifs {
+		var addresses []string
+
+		for _, a := range dev.Addresses {
+			addresses = append(addresses, a.IP.String())
+		}
+
+		tbl.Append([]string{
+			dev.Name,
+			strings.Join(addresses, "\n"),
+			dev.Description,
+		})
+	}
+
+	tbl.Render()
+
+	return nil
+}
@@ -8,7 +8,10 @@ import (
 	"io"
 	"net"
 	"regexp"
+	"sort"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"go.uber.org/zap"
 
@@ -24,45 +27,74 @@ var (
 	// ErrNoSSLHandshakeFound is used to indicate no handshake found
 	ErrNoTLSHandshakeFound = errors.New("No TLS handshake found")
 
+	// ErrNoCertificates is returned for handshakes the server didn't send a
+	// certificate in, or that failed before it did. The errors are
+	// HandshakeErrors.
+	ErrNoCertificates = errors.New("no certificates in the TLS handshake")
+
+	// ErrClientSide is returned for the client's side of a TLS connection,
+	// it starts with a ClientHello. It isn't counted as a failure.
+	ErrClientSide = errors.New("client side of a TLS connection")
+
+	// ErrEmptyStream is returned for a stream without any data. It isn't
+	// counted as a failure.
+	ErrEmptyStream = errors.New("empty stream")
+
+	// Reasons of a HandshakeError, errors.Is matches them against it.
+
+	// ErrTruncated is the reason for streams that ended, or lost data, before
+	// the server's certificates.
+	ErrTruncated = errors.New("stream truncated")
+	// ErrTLS13Encrypted is the reason for TLS 1.3 handshakes, the server's
+	// certificates are encrypted.
+	ErrTLS13Encrypted = errors.New("TLS 1.3, certificates are encrypted")
+	// ErrResumedSession is the reason for resumed sessions, the server
+	// doesn't send its certificates again.
+	ErrResumedSession = errors.New("resumed session")
+	// ErrNoServerCertificate is the reason for handshakes the server went
+	// on without a certificate in, e.g. with an anonymous or PSK cipher
+	// suite.
+	ErrNoServerCertificate = errors.New("the server sent no certificate")
+	// ErrParserBug is the reason for handshakes the parser panicked on.
+	ErrParserBug = errors.New("parser bug")
+
 	// IgnoredTLSErrors is a map of errors that do not keep the certificates
-	// from being extracted
+	// from being extracted.
+	//
+	// Deprecated: it is no longer consulted, certificates are kept whatever
+	// error ends the handshake after them. Streams without certificates
+	// fail with a HandshakeError, match its reason with errors.Is.
 	IgnoredTLSErrors = map[string]bool{
 		"tls: received unexpected handshake message of type *tls.clientHelloMsg when waiting for *tls.serverHelloMsg": true,
-		"crypto/rsa: verification error":                                                                              true,
-		"local error: bad record MAC":                                                                                 true,
-		"ECDSA verification failure":                                                                                  true,
-		"tls: server selected unsupported curve":                                                                      true,
-		"tls: unknown hash function used by peer":                                                                     true,
-		"missing ServerKeyExchange message":                                                                           true,
+		"crypto/rsa: verification error":          true,
+		"local error: bad record MAC":             true,
+		"ECDSA verification failure":              true,
+		"tls: server selected unsupported curve":  true,
+		"tls: unknown hash function used by peer": true,
+		"missing ServerKeyExchange message":       true,
 	}
+
+	// SSL handshake regex
+	defaultHandshakeRegex = regexp.MustCompile(`^\x16\x03[\x00\x01\x02\x03].*`)
 )
 
 const (
 	peekSz = 16
 )
 
-var (
-	// SSL handshake regex
-	serverHSRegex = regexp.MustCompile(`^\x16\x03[\x00\x01\x02\x03].*`)
-	// common name chars allowed in file name
-	allowedCNCchars = regexp.MustCompile(`([^a-zA-Z0-9_\.\-])`)
-	logLine         = "%s commonname:\"%s\" serial:%s fingerprint:%s"
-)
-
-func cleanupName(name string) string {
-	n := allowedCNCchars.ReplaceAllLiteralString(name, "")
-	if len(n) > 256 {
-		n = n[0:256]
-	}
-	return n
+// handshakeConfig is how streams are parsed, each Extractor has its own.
+type handshakeConfig struct {
+	// matches the first bytes of a stream starting with a server handshake
+	regex *regexp.Regexp
 }
 
-var atomicFlowIdx uint64
+func newHandshakeConfig() *handshakeConfig {
+	return &handshakeConfig{regex: defaultHandshakeRegex}
+}
 
 type fakeConn struct {
 	net.Conn
 	flow      io.Reader
-	idx       uint64
 	bytesRead int
 }
 
@@ -76,44 +108,105 @@ func (f *fakeConn) Write(b []byte) (int, error) {
 	return len(b), nil
 }
 
-type readerFactory struct {
-	logger *zap.SugaredLogger
-	output *output
+// timedStream is a tcpreader.ReaderStream that remembers when each chunk of
+// reassembled data was seen, so that positions in the stream can be mapped
+// back to capture timestamps. Only the beginning of a stream is tracked, which
+// is where the handshake happens.
+type timedStream struct {
+	tcpreader.ReaderStream
+
+	mu     sync.Mutex
+	start  time.Time
+	total  int
+	read   int
+	chunks []timedChunk
 }
 
-func (t *readerFactory) New(netflow gopacket.Flow, tcpflow gopacket.Flow) tcpassembly.Stream {
-	r := tcpreader.NewReaderStream()
-	h := newStreamHandler(&r, netflow, tcpflow, t.output, t.logger.Named("stream"))
+type timedChunk struct {
+	// offset one past the last byte of the chunk
+	end  int
+	seen time.Time
+}
+
+const maxTimedChunks = 1024
+
+func newTimedStream() *timedStream {
+	return &timedStream{
+		ReaderStream: tcpreader.NewReaderStream(),
+	}
+}
 
-	go func() {
-		// TODO: this should go someplace else...
-		defer r.Close()
-		err := h.Run()
-		if err != nil {
-			//log.Println(err)
+func (s *timedStream) Reassembled(reassembly []tcpassembly.Reassembly) {
+	s.mu.Lock()
+	for _, r := range reassembly {
+		if s.start.IsZero() {
+			s.start = r.Seen
 		}
-	}()
+		if len(r.Bytes) > 0 && len(s.chunks) < maxTimedChunks {
+			s.total += len(r.Bytes)
+			s.chunks = append(s.chunks, timedChunk{end: s.total, seen: r.Seen})
+		}
+	}
+	s.mu.Unlock()
+	s.ReaderStream.Reassembled(reassembly)
+}
+
+func (s *timedStream) Read(p []byte) (int, error) {
+	n, err := s.ReaderStream.Read(p)
+	s.mu.Lock()
+	s.read += n
+	s.mu.Unlock()
+	return n, err
+}
+
+// startTime returns the timestamp of the first packet of the stream.
+func (s *timedStream) startTime() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.start
+}
+
+// seenAt returns the timestamp of the packet holding the last byte consumed
+// from buffered, which must be reading from the stream.
+func (s *timedStream) seenAt(buffered *bufio.Reader) time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	return &r
+	offset := s.read - buffered.Buffered() - 1
+	if offset < 0 || len(s.chunks) == 0 {
+		return s.start
+	}
+	i := sort.Search(len(s.chunks), func(i int) bool {
+		return s.chunks[i].end > offset
+	})
+	if i == len(s.chunks) {
+		i--
+	}
+	return s.chunks[i].seen
 }
 
 type streamHandler struct {
 	r          io.Reader
+	stream     *timedStream
 	netflow    *gopacket.Flow
 	tcpflow    *gopacket.Flow
 	idx        uint64
 	foundCerts bool
-	output     *output
+	factory    *StreamFactory
+	flows      *flowTable
+	source     string
 	logger     *zap.SugaredLogger
 }
 
-func newStreamHandler(r io.Reader, netflow gopacket.Flow, tcpflow gopacket.Flow, output *output, logger *zap.SugaredLogger) *streamHandler {
+func newStreamHandler(stream *timedStream, netflow gopacket.Flow, tcpflow gopacket.Flow, factory *StreamFactory, flows *flowTable, logger *zap.SugaredLogger) *streamHandler {
 	return &streamHandler{
-		r:       r,
+		r:       stream,
+		stream:  stream,
 		netflow: &netflow,
 		tcpflow: &tcpflow,
-		idx:     atomic.AddUint64(&atomicFlowIdx, 1),
-		output:  output,
+		idx:     atomic.AddUint64(&factory.flowIdx, 1),
+		factory: factory,
+		flows:   flows,
 		logger:  logger,
 	}
 }
@@ -127,6 +220,22 @@ func (s *streamHandler) key() string {
 	return fmt.Sprintf("%s-%s-%s", src, s.tcpflow.Src(), dst)
 }
 
+// describe fills in the endpoints of the connection, what the client asked
+// for and where it was captured.
+func (s *streamHandler) describe(obs *Observation) {
+	src, dst := s.netflow.Endpoints()
+	sport, dport := s.tcpflow.Endpoints()
+	obs.FlowIndex = s.idx
+	obs.FlowHash = s.hash()
+	obs.Server = net.JoinHostPort(src.String(), sport.String())
+	obs.Client = net.JoinHostPort(dst.String(), dport.String())
+	obs.Source = s.source
+	if hello := s.flows.clientHello(*s.netflow, *s.tcpflow); hello != nil {
+		obs.ServerName = hello.ServerName
+		obs.JA3 = hello.ja3()
+	}
+}
+
 func (s *streamHandler) logPrefix() string {
 	src, dst := s.netflow.Endpoints()
 	//if Config.verbose {
@@ -136,71 +245,152 @@ func (s *streamHandler) logPrefix() string {
 	//return fmt.Sprintf("server:%s port:%s client:%s", src.String(), s.tcpflow.Src(), dst.String())
 }
 
+// debugf logs a debug message about the flow.
+func (s *streamHandler) debugf(format string, args ...interface{}) {
+	s.logger.Debugf("%s "+format, append([]interface{}{s.logPrefix()}, args...)...)
+}
+
+// Run reads the stream, hands a chain found to the factory's sink and reports
+// the outcome.
 func (s *streamHandler) Run() error {
 	defer func() {
 		n := tcpreader.DiscardBytesToEOF(s.r)
 		//if s.foundCerts && Config.veryVerbose {
 		if s.foundCerts {
-			s.logger.Debugf("%s DiscardBytesToEOF:%d", s.logPrefix(), n)
+			s.debugf("DiscardBytesToEOF:%d", n)
 		}
 	}()
 
 	data := bufio.NewReader(s.r)
-	t, err := data.Peek(peekSz)
 
-	if err != nil {
-		if err != io.EOF {
-			s.logger.Error(err)
-			return err
-		}
+	var obs Observation
+	_, err := s.factory.handshake.readHandshake(data, &obs, func() {
+		obs.CertificateSeen = s.stream.seenAt(data)
+	}, s.debugf)
+	if err == ErrEmptyStream {
 		return nil
 	}
 
-	header := make([]byte, peekSz)
-	copy(header, t)
+	obs.ConnectionStart = s.stream.startTime()
+	obs.HandshakeComplete = s.stream.seenAt(data)
+	obs.Processed = s.factory.now().UTC()
+	s.describe(&obs)
 
-	//if Config.veryVerbose {
-	s.logger.Debugf("%s header:%s", s.logPrefix(), hex.EncodeToString(header))
-	//}
+	s.foundCerts = len(obs.Chain) > 0
+	if !s.foundCerts {
+		s.flows.markDone(*s.netflow, *s.tcpflow)
+		// TODO(jca): handshake but no certs??
+		s.factory.report(FlowResult{Observation: obs, Err: err})
+		return err
+	}
 
-	if s.isTLSHandshake(header) {
-		certs, err := s.extractCertificates(&fakeConn{flow: data, idx: s.idx})
-		if err != nil {
-			return err
+	// the server flight has been read, the rest of the connection is of no
+	// interest
+	s.flows.markConnectionDone(*s.netflow, *s.tcpflow)
+	err = s.factory.observe(obs)
+	s.factory.report(FlowResult{Observation: obs, Err: err})
+	return err
+}
+
+// readHandshake reads the server side of a connection, past a PROXY protocol
+// header or a STARTTLS exchange, up to the end of the server's handshake
+// flight. The negotiated parameters and the chain are filled in to obs,
+// onCertificates is called once the certificate message has been read. If
+// the chain was read, a later error of the handshake is returned with it.
+func (c *handshakeConfig) readHandshake(data *bufio.Reader, obs *Observation, onCertificates func(),
+	debugf func(string, ...interface{})) (verdict, error) {
+	v, err := stripPreamble(data)
+	if err != nil {
+		if err == io.EOF {
+			if v == verdictUnknown {
+				return v, ErrEmptyStream
+			}
+			return v, ErrNoTLSHandshakeFound
 		}
+		debugf("preamble:%s %v", v, err)
+		return v, fmt.Errorf("%s preamble: %v: %w", v, err, ErrNoTLSHandshakeFound)
+	}
+	if v == verdictProxy || v == verdictSTARTTLS {
+		debugf("preamble:%s", v)
+	}
 
-		s.foundCerts = len(certs) > 0
+	header, err := data.Peek(peekSz)
+	if err == io.EOF {
+		return v, ErrNoTLSHandshakeFound
+	}
+	if err != nil {
+		return v, err
+	}
 
-		if s.foundCerts {
-			s.output.PersistCertificate(certs, s.logPrefix())
-		}
+	//if Config.veryVerbose {
+	debugf("header:%s", hex.EncodeToString(header))
+	//}
 
-		// TODO(jca): handshake but no certs??
+	if !c.regex.Match(header) {
+		return v, ErrNoTLSHandshakeFound
+	}
+	if header[recordHeaderLen] == handshakeTypeClientHello {
+		return v, ErrClientSide
+	}
 
-		return nil
+	hello, _ := peekServerHello(data)
+	resumed := false
+	if hello != nil {
+		obs.Version = hello.negotiatedVersion()
+		obs.CipherSuite = hello.CipherSuite
+		obs.JA3S = hello.ja3s()
+		resumed = peekResumption(data)
+	}
+
+	obs.Chain, err = extractCertificates(&fakeConn{flow: data}, onCertificates)
+	if len(obs.Chain) == 0 {
+		debugf("%s %v", redError("ERROR"), err)
+		return v, &HandshakeError{Reason: failureReason(hello, resumed, err), Err: err}
+	}
+	if err != nil {
+		// the key exchange isn't checked against anything, errors after the
+		// certificates are harmless
+		debugf("after certificates: %v", err)
 	}
-	return ErrNoTLSHandshakeFound
+	return v, err
 }
 
-func (s *streamHandler) extractCertificates(conn net.Conn) ([]*x509.Certificate, error) {
-	client := tls_clone.Client(conn, &tls_clone.Config{InsecureSkipVerify: true})
-	err := client.Handshake()
-	if !IgnoredTLSErrors[err.Error()] {
-		//if s.netflow != nil && Config.verbose {
-		if s.netflow != nil {
-			if len(client.PeerCertificates()) == 0 {
-				s.logger.Debugf("%s %s %v", redError("ERROR"), s.logPrefix(), err)
-			} else {
-				// possibly ignoreable error
-				s.logger.Debugf("%s %s %v", redError("ADD TO IGNORE"), s.logPrefix(), err)
-			}
-		}
+// failureReason tells why a handshake ended without certificates, nil if
+// the reason isn't known, e.g. an alert from the server.
+func failureReason(hello *serverHello, resumed bool, err error) error {
+	switch {
+	case errors.Is(err, ErrParserBug):
+		return ErrParserBug
+	case hello != nil && hello.negotiatedVersion() >= versionTLS13:
+		return ErrTLS13Encrypted
+	case resumed && errors.Is(err, tls_clone.ErrUnexpectedMessage):
+		return ErrResumedSession
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		return ErrTruncated
+	case hello != nil && errors.Is(err, tls_clone.ErrUnexpectedMessage):
+		// something else than a Certificate followed the ServerHello
+		return ErrNoServerCertificate
 	}
-	// TODO: log various errors. some are interesting.
-	certs := client.PeerCertificates()
-	return certs, nil
+	return nil
 }
 
-func (s *streamHandler) isTLSHandshake(data []byte) bool {
-	return serverHSRegex.Match(data)
+// extractCertificates runs a client handshake against conn, which replays
+// the server side of a connection, and returns the certificates the server
+// sent along with the error the handshake ended with. A panic of the
+// handshake is returned as an error matching ErrParserBug.
+func extractCertificates(conn net.Conn, onCertificates func()) (certs []*x509.Certificate, err error) {
+	client := tls_clone.Client(conn, &tls_clone.Config{
+		InsecureSkipVerify: true,
+		PeerCertificatesHook: func([]*x509.Certificate) {
+			onCertificates()
+		},
+	})
+	defer func() {
+		if r := recover(); r != nil {
+			certs, err = client.PeerCertificates(), fmt.Errorf("%w: %v", ErrParserBug, r)
+		}
+	}()
+	err = client.Handshake()
+	// TODO: log various errors. some are interesting.
+	return client.PeerCertificates(), err
 }
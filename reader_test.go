@@ -0,0 +1,199 @@
+package certgrep
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/kung-foo/certgrep/testdata"
+)
+
+// record frames body as a TLS 1.1 record of the given type.
+func record(typ byte, body ...[]byte) []byte {
+	b := bytes.Join(body, nil)
+	return append([]byte{typ, 0x03, 0x02, byte(len(b) >> 8), byte(len(b))}, b...)
+}
+
+// handshake frames body as a handshake message of the given type.
+func handshake(typ byte, body []byte) []byte {
+	n := len(body)
+	return append([]byte{typ, byte(n >> 16), byte(n >> 8), byte(n)}, body...)
+}
+
+func join(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+var (
+	// the ServerHello record of testdata.Stream1, followed by its
+	// Certificate record
+	stream1Hello = testdata.Stream1[:54]
+
+	changeCipherSpec = record(recordTypeChangeCipherSpec, []byte{1})
+	sessionTicket    = record(recordTypeHandshake, handshake(handshakeTypeNewSessionTicket, make([]byte, 6)))
+	serverHelloDone  = record(recordTypeHandshake, handshake(0x0e, nil))
+	handshakeAlert   = record(0x15, []byte{2, 40})
+
+	// a TLS 1.3 ServerHello: legacy version TLS 1.2, TLS_AES_128_GCM_SHA256
+	// and supported_versions
+	tls13Hello = record(recordTypeHandshake, handshake(handshakeTypeServerHello, join(
+		[]byte{0x03, 0x03}, make([]byte, 32), []byte{0},
+		[]byte{0x13, 0x01, 0},
+		[]byte{0, 6, 0, 43, 0, 2, 0x03, 0x04},
+	)))
+)
+
+func TestHandshakeError(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    *HandshakeError
+		target error
+		is     bool
+		msg    string
+	}{
+		{
+			name:   "no certificates",
+			err:    &HandshakeError{Err: io.EOF},
+			target: ErrNoCertificates,
+			is:     true,
+			msg:    "no certificates in the TLS handshake: EOF",
+		},
+		{
+			name:   "reason",
+			err:    &HandshakeError{Reason: ErrTruncated, Err: io.ErrUnexpectedEOF},
+			target: ErrTruncated,
+			is:     true,
+			msg:    "no certificates in the TLS handshake: stream truncated: unexpected EOF",
+		},
+		{
+			name:   "other reason",
+			err:    &HandshakeError{Reason: ErrTruncated, Err: io.ErrUnexpectedEOF},
+			target: ErrResumedSession,
+			is:     false,
+		},
+		{
+			name:   "wrapped error",
+			err:    &HandshakeError{Reason: ErrTruncated, Err: io.ErrUnexpectedEOF},
+			target: io.ErrUnexpectedEOF,
+			is:     true,
+		},
+		{
+			name:   "no reason",
+			err:    &HandshakeError{Err: errors.New("remote error: handshake failure")},
+			target: ErrTruncated,
+			is:     false,
+			msg:    "no certificates in the TLS handshake: remote error: handshake failure",
+		},
+		{
+			name:   "error is the reason",
+			err:    &HandshakeError{Reason: ErrParserBug, Err: ErrParserBug},
+			target: ErrParserBug,
+			is:     true,
+			msg:    "no certificates in the TLS handshake: parser bug",
+		},
+		{
+			name:   "not another sentinel",
+			err:    &HandshakeError{Reason: ErrTruncated},
+			target: ErrNoTLSHandshakeFound,
+			is:     false,
+			msg:    "no certificates in the TLS handshake: stream truncated",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if is := errors.Is(tt.err, tt.target); is != tt.is {
+				t.Errorf("errors.Is(%v, %v) = %v, want %v", tt.err, tt.target, is, tt.is)
+			}
+			if tt.msg != "" && tt.err.Error() != tt.msg {
+				t.Errorf("Error() = %q, want %q", tt.err.Error(), tt.msg)
+			}
+		})
+	}
+}
+
+func TestParseStreamFailures(t *testing.T) {
+	tests := []struct {
+		name     string
+		stream   []byte
+		chain    bool
+		err      error
+		kind     string
+		preamble string
+	}{
+		{name: "chain", stream: testdata.Stream1, chain: true, preamble: "tls"},
+		{
+			name:     "proxy header",
+			stream:   join([]byte("PROXY TCP4 10.0.0.1 10.0.0.2 443 51000\r\n"), testdata.Stream1),
+			chain:    true,
+			preamble: "proxy",
+		},
+		{
+			name:     "starttls",
+			stream:   join([]byte("220 mx ESMTP\r\n220 2.0.0 Ready to start TLS\r\n"), testdata.Stream1),
+			chain:    true,
+			preamble: "starttls",
+		},
+		{name: "empty", err: ErrEmptyStream},
+		{name: "not tls", stream: []byte("HTTP/1.1 200 OK\r\n\r\n"), err: ErrNoTLSHandshakeFound, kind: failureNotTLS},
+		{
+			name:   "client side",
+			stream: record(recordTypeHandshake, handshake(handshakeTypeClientHello, make([]byte, 40))),
+			err:    ErrClientSide,
+		},
+		{name: "truncated", stream: testdata.Stream1[:600], err: ErrTruncated, kind: failureTruncated},
+		{name: "tls 1.3", stream: join(tls13Hello, changeCipherSpec), err: ErrTLS13Encrypted, kind: failureTLS13},
+		{name: "resumed", stream: join(stream1Hello, changeCipherSpec), err: ErrResumedSession, kind: failureResumed},
+		{name: "session ticket", stream: join(stream1Hello, sessionTicket), err: ErrResumedSession, kind: failureResumed},
+		{
+			name:   "no certificate",
+			stream: join(stream1Hello, serverHelloDone),
+			err:    ErrNoServerCertificate,
+			kind:   failureNoCert,
+		},
+		{name: "alert", stream: join(stream1Hello, handshakeAlert), err: ErrNoCertificates, kind: failureOther},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := ParseStream(bytes.NewReader(tt.stream), Meta{})
+			if tt.err == nil {
+				if err != nil {
+					t.Fatalf("ParseStream() error = %v", err)
+				}
+			} else if !errors.Is(err, tt.err) {
+				t.Fatalf("ParseStream() error = %v, want %v", err, tt.err)
+			}
+			if tt.kind != "" {
+				if kind := failureKind(err); kind != tt.kind {
+					t.Errorf("failureKind(%v) = %q, want %q", err, kind, tt.kind)
+				}
+			}
+			if chain := result != nil && len(result.Chain) > 0; chain != tt.chain {
+				t.Fatalf("chain extracted = %v, want %v", chain, tt.chain)
+			}
+			if tt.preamble != "" && result.Preamble != tt.preamble {
+				t.Errorf("Preamble = %q, want %q", result.Preamble, tt.preamble)
+			}
+		})
+	}
+}
+
+func TestHandshakeFailuresAdd(t *testing.T) {
+	var f HandshakeFailures
+	for _, err := range []error{
+		ErrNoTLSHandshakeFound,
+		&HandshakeError{Reason: ErrTruncated},
+		&HandshakeError{Reason: ErrTLS13Encrypted},
+		&HandshakeError{Reason: ErrResumedSession},
+		&HandshakeError{Reason: ErrResumedSession},
+		&HandshakeError{Reason: ErrNoServerCertificate},
+		&HandshakeError{Reason: ErrParserBug},
+		&HandshakeError{Err: errors.New("remote error: handshake failure")},
+	} {
+		f.add(err)
+	}
+	want := HandshakeFailures{NotTLS: 1, Truncated: 1, TLS13: 1, Resumed: 2, NoCertificate: 1, ParserBug: 1, Other: 1}
+	if f != want {
+		t.Errorf("HandshakeFailures = %+v, want %+v", f, want)
+	}
+}
@@ -0,0 +1,85 @@
+package certgrep
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/x509"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Observation is a certificate chain sent by a server, where it was seen,
+// the capture timestamps of the connection, and the time certgrep processed
+// it.
+type Observation struct {
+	// leaf first, as sent by the server
+	Chain []*x509.Certificate `json:"-"`
+
+	FlowIndex   uint64 `json:"flow_index"`
+	FlowHash    string `json:"flow_hash"`
+	Server      string `json:"server"`
+	Client      string `json:"client"`
+	ServerName  string `json:"server_name,omitempty"`
+	Source      string `json:"source,omitempty"`
+	Version     uint16 `json:"version"`
+	CipherSuite uint16 `json:"cipher_suite"`
+	JA3         string `json:"ja3,omitempty"`
+	JA3S        string `json:"ja3s,omitempty"`
+
+	ConnectionStart   time.Time `json:"connection_start"`
+	CertificateSeen   time.Time `json:"certificate_seen"`
+	HandshakeComplete time.Time `json:"handshake_complete"`
+	Processed         time.Time `json:"processed"`
+}
+
+// seen returns the capture time of the certificate message, falling back to
+// the processing time if the capture time isn't known.
+func (o Observation) seen() time.Time {
+	if o.CertificateSeen.IsZero() {
+		return o.Processed
+	}
+	return o.CertificateSeen
+}
+
+// connectionID identifies the connection an observation was made on. It is
+// stable across runs over the same capture.
+func (o Observation) connectionID() []byte {
+	return digestParts(o.Source, strconv.FormatUint(o.FlowIndex, 10),
+		o.Server, o.Client, o.ConnectionStart.UTC().Format(time.RFC3339Nano))
+}
+
+// logPrefix describes the flow in the certificate log.
+func (o Observation) logPrefix() string {
+	client, _ := splitHostPort(o.Client)
+	server, port := splitHostPort(o.Server)
+	return fmt.Sprintf("flowidx:%d flowhash:%s client:%s server:%s port:%d",
+		o.FlowIndex, o.FlowHash, client, server, port)
+}
+
+// digestParts hashes a list of strings, parts are NUL separated.
+func digestParts(parts ...string) []byte {
+	h := sha1.New()
+	for _, part := range parts {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	return h.Sum(nil)
+}
+
+// Sink receives every certificate chain extracted, in addition to or instead
+// of the files written to the output directory. Observe is called from a
+// single goroutine, in capture order, so a slow sink holds up the output.
+// The chain must not be modified. Errors are handled like failed writes, see
+// OnWriteFailure. Close is called once, after the last observation. The
+// context carries the values of the one passed to Extractor.Run, but isn't
+// cancelled with it: chains in flight are still handed to the sinks.
+type Sink interface {
+	Observe(ctx context.Context, obs Observation) error
+	Close() error
+}
+
+// flusher is implemented by sinks that batch, flush is called periodically.
+type flusher interface {
+	flush() error
+}
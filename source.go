@@ -0,0 +1,36 @@
+package certgrep
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// PacketSource is where the Extractor reads packets from: a live capture, a
+// capture file or packets generated in memory. The pcapsource package adapts
+// libpcap handles, readers of the gopacket pcapgo package satisfy it as they
+// are. ReadPacketData returning io.EOF ends the capture.
+type PacketSource interface {
+	gopacket.PacketDataSource
+	LinkType() layers.LinkType
+}
+
+// PacketStats are the counters of a capture, as kept by the kernel or the
+// capture library.
+type PacketStats struct {
+	PacketsReceived  int
+	PacketsDropped   int
+	PacketsIfDropped int
+}
+
+// StatsSource is implemented by packet sources that count packets received
+// and dropped before they could be read. The statistics are part of the
+// Summary of a run.
+type StatsSource interface {
+	Stats() (PacketStats, error)
+}
+
+// FilterSource is implemented by packet sources that can apply a capture
+// filter, see CaptureFilter.
+type FilterSource interface {
+	SetBPFFilter(expr string) error
+}
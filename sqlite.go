@@ -0,0 +1,308 @@
+package certgrep
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"database/sql"
+	"encoding/hex"
+	"net"
+	"strconv"
+	"time"
+
+	// registers the sqlite3 database/sql driver
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const (
+	// chains are committed in batches, a transaction per chain is too slow
+	sqliteBatchSize = 500
+	// fixed width so that timestamps sort as text
+	sqliteTimeFormat = "2006-01-02T15:04:05.000000Z"
+)
+
+var sqliteSchema = []string{
+	`CREATE TABLE IF NOT EXISTS certificates (
+		id                   INTEGER PRIMARY KEY,
+		sha256               TEXT NOT NULL UNIQUE,
+		sha1                 TEXT NOT NULL,
+		der                  BLOB NOT NULL,
+		subject              TEXT NOT NULL,
+		subject_cn           TEXT NOT NULL,
+		issuer               TEXT NOT NULL,
+		issuer_cn            TEXT NOT NULL,
+		serial               TEXT NOT NULL,
+		not_before           TEXT NOT NULL,
+		not_after            TEXT NOT NULL,
+		is_ca                INTEGER NOT NULL,
+		public_key_algorithm TEXT NOT NULL,
+		signature_algorithm  TEXT NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS certificates_sha1 ON certificates (sha1)`,
+	`CREATE INDEX IF NOT EXISTS certificates_subject ON certificates (subject)`,
+	`CREATE INDEX IF NOT EXISTS certificates_subject_cn ON certificates (subject_cn)`,
+	`CREATE INDEX IF NOT EXISTS certificates_issuer ON certificates (issuer)`,
+
+	// subject alternative names
+	`CREATE TABLE IF NOT EXISTS certificate_names (
+		certificate_id INTEGER NOT NULL REFERENCES certificates (id),
+		type           TEXT NOT NULL,
+		name           TEXT NOT NULL,
+		UNIQUE (certificate_id, type, name)
+	)`,
+	`CREATE INDEX IF NOT EXISTS certificate_names_name ON certificate_names (name)`,
+
+	// a chain is identified by a hash over the ordered certificate digests
+	`CREATE TABLE IF NOT EXISTS chains (
+		id     INTEGER PRIMARY KEY,
+		hash   TEXT NOT NULL UNIQUE,
+		length INTEGER NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS chain_certificates (
+		chain_id       INTEGER NOT NULL REFERENCES chains (id),
+		position       INTEGER NOT NULL,
+		certificate_id INTEGER NOT NULL REFERENCES certificates (id),
+		PRIMARY KEY (chain_id, position)
+	)`,
+	`CREATE INDEX IF NOT EXISTS chain_certificates_certificate ON chain_certificates (certificate_id)`,
+
+	`CREATE TABLE IF NOT EXISTS sessions (
+		id                 INTEGER PRIMARY KEY,
+		chain_id           INTEGER NOT NULL REFERENCES chains (id),
+		server_ip          TEXT NOT NULL,
+		server_port        INTEGER NOT NULL,
+		client_ip          TEXT NOT NULL,
+		client_port        INTEGER NOT NULL,
+		server_name        TEXT NOT NULL,
+		version            TEXT NOT NULL,
+		cipher_suite       TEXT NOT NULL,
+		connection_start   TEXT,
+		certificate_seen   TEXT,
+		handshake_complete TEXT,
+		processed          TEXT NOT NULL,
+		source             TEXT NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS sessions_server_ip ON sessions (server_ip)`,
+	`CREATE INDEX IF NOT EXISTS sessions_server_name ON sessions (server_name)`,
+	`CREATE INDEX IF NOT EXISTS sessions_certificate_seen ON sessions (certificate_seen)`,
+
+	// aggregated per certificate and server
+	`CREATE TABLE IF NOT EXISTS sightings (
+		certificate_id INTEGER NOT NULL REFERENCES certificates (id),
+		server_ip      TEXT NOT NULL,
+		server_port    INTEGER NOT NULL,
+		server_name    TEXT NOT NULL,
+		first_seen     TEXT NOT NULL,
+		last_seen      TEXT NOT NULL,
+		count          INTEGER NOT NULL,
+		PRIMARY KEY (certificate_id, server_ip, server_port, server_name)
+	)`,
+	`CREATE INDEX IF NOT EXISTS sightings_server_ip ON sightings (server_ip)`,
+}
+
+// sqliteWriter writes certificates, chains, sessions and sightings to a
+// normalised SQLite database.
+type sqliteWriter struct {
+	db      *sql.DB
+	tx      *sql.Tx
+	pending int
+}
+
+func newSQLiteWriter(path string) (*sqliteWriter, error) {
+	db, err := sql.Open("sqlite3", path+"?_journal_mode=WAL&_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+	for _, stmt := range sqliteSchema {
+		if _, err = db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return &sqliteWriter{db: db}, nil
+}
+
+func (w *sqliteWriter) Observe(_ context.Context, obs Observation) (err error) {
+	if w.tx == nil {
+		if w.tx, err = w.db.Begin(); err != nil {
+			return
+		}
+	}
+
+	ids := make([]int64, len(obs.Chain))
+	for i, cert := range obs.Chain {
+		if ids[i], err = w.certificate(cert); err != nil {
+			return
+		}
+	}
+
+	chainID, err := w.chain(obs.Chain, ids)
+	if err != nil {
+		return
+	}
+
+	serverIP, serverPort := splitHostPort(obs.Server)
+	clientIP, clientPort := splitHostPort(obs.Client)
+
+	_, err = w.tx.Exec(`INSERT INTO sessions (chain_id, server_ip, server_port,
+			client_ip, client_port, server_name, version, cipher_suite,
+			connection_start, certificate_seen, handshake_complete, processed, source)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		chainID, serverIP, serverPort, clientIP, clientPort, obs.ServerName,
+		versionName(obs.Version), cipherSuiteName(obs.CipherSuite),
+		sqliteTime(obs.ConnectionStart), sqliteTime(obs.CertificateSeen),
+		sqliteTime(obs.HandshakeComplete), sqliteTime(obs.Processed), obs.Source)
+	if err != nil {
+		return
+	}
+
+	seen := sqliteTime(obs.seen())
+	for _, id := range ids {
+		_, err = w.tx.Exec(`INSERT INTO sightings (certificate_id, server_ip,
+				server_port, server_name, first_seen, last_seen, count)
+			VALUES (?, ?, ?, ?, ?, ?, 1)
+			ON CONFLICT (certificate_id, server_ip, server_port, server_name) DO UPDATE SET
+				first_seen = min(first_seen, excluded.first_seen),
+				last_seen = max(last_seen, excluded.last_seen),
+				count = count + 1`,
+			id, serverIP, serverPort, obs.ServerName, seen, seen)
+		if err != nil {
+			return
+		}
+	}
+
+	w.pending++
+	if w.pending >= sqliteBatchSize {
+		return w.flush()
+	}
+	return
+}
+
+// certificate inserts cert unless it is already known and returns its id.
+func (w *sqliteWriter) certificate(cert *x509.Certificate) (id int64, err error) {
+	sum := sha256.Sum256(cert.Raw)
+	digest := hex.EncodeToString(sum[:])
+
+	err = w.tx.QueryRow(`SELECT id FROM certificates WHERE sha256 = ?`, digest).Scan(&id)
+	if err != sql.ErrNoRows {
+		return
+	}
+
+	sum1 := sha1.Sum(cert.Raw)
+	res, err := w.tx.Exec(`INSERT INTO certificates (sha256, sha1, der, subject,
+			subject_cn, issuer, issuer_cn, serial, not_before, not_after, is_ca,
+			public_key_algorithm, signature_algorithm)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		digest, hex.EncodeToString(sum1[:]), cert.Raw,
+		cert.Subject.String(), cert.Subject.CommonName,
+		cert.Issuer.String(), cert.Issuer.CommonName,
+		cert.SerialNumber.Text(16),
+		sqliteTime(cert.NotBefore), sqliteTime(cert.NotAfter), cert.IsCA,
+		cert.PublicKeyAlgorithm.String(), cert.SignatureAlgorithm.String())
+	if err != nil {
+		return
+	}
+	if id, err = res.LastInsertId(); err != nil {
+		return
+	}
+
+	var ips, uris []string
+	for _, ip := range cert.IPAddresses {
+		ips = append(ips, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		uris = append(uris, uri.String())
+	}
+	for _, names := range []struct {
+		typ  string
+		list []string
+	}{
+		{"dns", cert.DNSNames},
+		{"ip", ips},
+		{"email", cert.EmailAddresses},
+		{"uri", uris},
+	} {
+		for _, name := range names.list {
+			_, err = w.tx.Exec(`INSERT OR IGNORE INTO certificate_names
+				(certificate_id, type, name) VALUES (?, ?, ?)`, id, names.typ, name)
+			if err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// chain inserts the ordered chain unless it is already known and returns its
+// id.
+func (w *sqliteWriter) chain(certs []*x509.Certificate, ids []int64) (id int64, err error) {
+	hash := chainHash(certs)
+
+	err = w.tx.QueryRow(`SELECT id FROM chains WHERE hash = ?`, hash).Scan(&id)
+	if err != sql.ErrNoRows {
+		return
+	}
+
+	res, err := w.tx.Exec(`INSERT INTO chains (hash, length) VALUES (?, ?)`, hash, len(certs))
+	if err != nil {
+		return
+	}
+	if id, err = res.LastInsertId(); err != nil {
+		return
+	}
+
+	for i, certID := range ids {
+		_, err = w.tx.Exec(`INSERT INTO chain_certificates (chain_id, position,
+			certificate_id) VALUES (?, ?, ?)`, id, i, certID)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (w *sqliteWriter) flush() error {
+	if w.tx == nil {
+		return nil
+	}
+	err := w.tx.Commit()
+	w.tx = nil
+	w.pending = 0
+	return err
+}
+
+func (w *sqliteWriter) Close() error {
+	err := w.flush()
+	if cerr := w.db.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// chainHash identifies a chain by hashing the ordered SHA-256 digests of its
+// certificates.
+func chainHash(certs []*x509.Certificate) string {
+	h := sha256.New()
+	for _, cert := range certs {
+		sum := sha256.Sum256(cert.Raw)
+		h.Write(sum[:])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func sqliteTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t.UTC().Format(sqliteTimeFormat)
+}
+
+func splitHostPort(hostport string) (string, int) {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return hostport, 0
+	}
+	p, _ := strconv.Atoi(port)
+	return host, p
+}
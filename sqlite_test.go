@@ -0,0 +1,125 @@
+//go:build cgo
+// +build cgo
+
+package certgrep
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func init() {
+	deterministicFormats = append(deterministicFormats, "sqlite")
+}
+
+// count returns the number of rows of table in the database at path, read
+// over a connection of its own.
+func count(t *testing.T, path, table string) int {
+	t.Helper()
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var n int
+	if err = db.QueryRow(`SELECT count(*) FROM ` + table).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestSQLiteWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "certificates.db")
+	obs := stream1Observation(t)
+	seen := time.Date(2015, 4, 3, 7, 49, 20, 0, time.UTC)
+
+	// the schema is created once, a second run adds to the same database
+	for run := 0; run < 2; run++ {
+		w, err := newSQLiteWriter(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		obs.CertificateSeen = seen.Add(time.Duration(run) * time.Hour)
+		if err = w.Observe(context.Background(), obs); err != nil {
+			t.Fatal(err)
+		}
+		if err = w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for table, want := range map[string]int{
+		"certificates":       1,
+		"certificate_names":  len(obs.Chain[0].DNSNames),
+		"chains":             1,
+		"chain_certificates": 1,
+		"sessions":           2,
+		"sightings":          1,
+	} {
+		if n := count(t, path, table); n != want {
+			t.Errorf("%d rows in %s, want %d", n, table, want)
+		}
+	}
+
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var (
+		subjectCN, serverIP, serverName, firstSeen, lastSeen string
+		serverPort, n                                        int
+	)
+	err = db.QueryRow(`SELECT c.subject_cn, s.server_ip, s.server_port, s.server_name,
+			s.first_seen, s.last_seen, s.count
+		FROM sightings s JOIN certificates c ON c.id = s.certificate_id`).
+		Scan(&subjectCN, &serverIP, &serverPort, &serverName, &firstSeen, &lastSeen, &n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subjectCN != "www.vxdb.io" || serverIP != "10.0.0.2" || serverPort != 443 || serverName != obs.ServerName {
+		t.Errorf("sighting of %q on %s:%d (%q)", subjectCN, serverIP, serverPort, serverName)
+	}
+	if firstSeen != "2015-04-03T07:49:20.000000Z" || lastSeen != "2015-04-03T08:49:20.000000Z" || n != 2 {
+		t.Errorf("seen %d times from %s to %s", n, firstSeen, lastSeen)
+	}
+}
+
+func TestSQLiteWriterBatches(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "certificates.db")
+	w, err := newSQLiteWriter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	obs := stream1Observation(t)
+
+	for i := 0; i < sqliteBatchSize-1; i++ {
+		if err = w.Observe(context.Background(), obs); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := count(t, path, "sessions"); n != 0 {
+		t.Errorf("%d sessions committed before the batch is full", n)
+	}
+	if err = w.Observe(context.Background(), obs); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(t, path, "sessions"); n != sqliteBatchSize {
+		t.Errorf("%d sessions committed, want %d", n, sqliteBatchSize)
+	}
+
+	// the rest is committed on Close
+	if err = w.Observe(context.Background(), obs); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(t, path, "sessions"); n != sqliteBatchSize+1 {
+		t.Errorf("%d sessions committed, want %d", n, sqliteBatchSize+1)
+	}
+}
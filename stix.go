@@ -0,0 +1,328 @@
+package certgrep
+
+import (
+	"bytes"
+	"context"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+const (
+	stixSpecVersion = "2.1"
+	stixTimeFormat  = "2006-01-02T15:04:05.000Z"
+	// handshakes per bundle, a new one is started past that
+	stixBundleSize = 10000
+)
+
+// stixNamespace is the UUIDv5 namespace of STIX Cyber-observable Object ids
+// (STIX 2.1, section 2.9).
+var stixNamespace = [16]byte{
+	0x00, 0xab, 0xed, 0xb4, 0xaa, 0x42, 0x46, 0x6c,
+	0x9c, 0x01, 0xfe, 0xd2, 0x33, 0x15, 0xa9, 0xb7,
+}
+
+type stixBundle struct {
+	Type    string        `json:"type"`
+	ID      string        `json:"id"`
+	Objects []interface{} `json:"objects"`
+}
+
+type stixCertificate struct {
+	Type                      string            `json:"type"`
+	SpecVersion               string            `json:"spec_version"`
+	ID                        string            `json:"id"`
+	Hashes                    map[string]string `json:"hashes"`
+	Version                   string            `json:"version"`
+	SerialNumber              string            `json:"serial_number"`
+	SignatureAlgorithm        string            `json:"signature_algorithm,omitempty"`
+	Issuer                    string            `json:"issuer"`
+	ValidityNotBefore         string            `json:"validity_not_before"`
+	ValidityNotAfter          string            `json:"validity_not_after"`
+	Subject                   string            `json:"subject"`
+	SubjectPublicKeyAlgorithm string            `json:"subject_public_key_algorithm,omitempty"`
+	SubjectPublicKeyModulus   string            `json:"subject_public_key_modulus,omitempty"`
+	SubjectPublicKeyExponent  int               `json:"subject_public_key_exponent,omitempty"`
+}
+
+// stixValue is an ipv4-addr, ipv6-addr or domain-name.
+type stixValue struct {
+	Type           string   `json:"type"`
+	SpecVersion    string   `json:"spec_version"`
+	ID             string   `json:"id"`
+	Value          string   `json:"value"`
+	ResolvesToRefs []string `json:"resolves_to_refs,omitempty"`
+}
+
+type stixNetworkTraffic struct {
+	Type        string   `json:"type"`
+	SpecVersion string   `json:"spec_version"`
+	ID          string   `json:"id"`
+	Start       string   `json:"start,omitempty"`
+	SrcRef      string   `json:"src_ref"`
+	DstRef      string   `json:"dst_ref"`
+	SrcPort     int      `json:"src_port"`
+	DstPort     int      `json:"dst_port"`
+	Protocols   []string `json:"protocols"`
+	// the chain sent by the server, leaf first
+	ChainRefs []string `json:"x_certgrep_certificate_chain_refs"`
+}
+
+type stixObservedData struct {
+	Type           string   `json:"type"`
+	SpecVersion    string   `json:"spec_version"`
+	ID             string   `json:"id"`
+	Created        string   `json:"created"`
+	Modified       string   `json:"modified"`
+	FirstObserved  string   `json:"first_observed"`
+	LastObserved   string   `json:"last_observed"`
+	NumberObserved int      `json:"number_observed"`
+	ObjectRefs     []string `json:"object_refs"`
+}
+
+// stixWriter collects STIX 2.1 bundles of the observed certificates, the
+// servers' addresses, SNI domain names, the connections between them and an
+// observed-data object per handshake. A bundle is written to stix-NNNN.json
+// once it holds stixBundleSize handshakes, and when the output is closed.
+// Every bundle stands on its own: cyber-observable objects are included once
+// per bundle. Ids are deterministic, bundles' included.
+type stixWriter struct {
+	fs      fileSystem
+	dir     string
+	objects []interface{}
+	// of objects, in the same order
+	ids []string
+	// cyber-observable objects by id
+	seen       map[string]interface{}
+	handshakes int
+	seq        int
+}
+
+func newSTIXWriter(fs fileSystem, dir string) *stixWriter {
+	return &stixWriter{fs: fs, dir: dir, seen: make(map[string]interface{})}
+}
+
+func (w *stixWriter) add(id string, obj interface{}) {
+	if _, ok := w.seen[id]; ok {
+		return
+	}
+	w.seen[id] = obj
+	w.objects = append(w.objects, obj)
+	w.ids = append(w.ids, id)
+}
+
+func (w *stixWriter) Observe(_ context.Context, obs Observation) error {
+	if len(obs.Chain) == 0 {
+		return nil
+	}
+
+	chain := make([]string, len(obs.Chain))
+	for i, cert := range obs.Chain {
+		crt := newSTIXCertificate(cert)
+		chain[i] = crt.ID
+		w.add(crt.ID, crt)
+	}
+
+	clientIP, clientPort := splitHostPort(obs.Client)
+	serverIP, serverPort := splitHostPort(obs.Server)
+	client := w.address(clientIP)
+	server := w.address(serverIP)
+	network := "ipv4"
+	if server.Type == "ipv6-addr" {
+		network = "ipv6"
+	}
+
+	traffic := &stixNetworkTraffic{
+		Type:        "network-traffic",
+		SpecVersion: stixSpecVersion,
+		Start:       stixTime(obs.ConnectionStart),
+		SrcRef:      client.ID,
+		DstRef:      server.ID,
+		SrcPort:     clientPort,
+		DstPort:     serverPort,
+		Protocols:   []string{network, "tcp", "tls"},
+		ChainRefs:   chain,
+	}
+	contributing := map[string]interface{}{
+		"src_ref":   traffic.SrcRef,
+		"dst_ref":   traffic.DstRef,
+		"src_port":  traffic.SrcPort,
+		"dst_port":  traffic.DstPort,
+		"protocols": traffic.Protocols,
+	}
+	if traffic.Start != "" {
+		contributing["start"] = traffic.Start
+	}
+	traffic.ID = stixID(traffic.Type, contributing)
+	w.add(traffic.ID, traffic)
+
+	refs := []string{traffic.ID, client.ID, server.ID}
+	if obs.ServerName != "" {
+		domain := w.value("domain-name", obs.ServerName)
+		if !containsString(domain.ResolvesToRefs, server.ID) {
+			domain.ResolvesToRefs = append(domain.ResolvesToRefs, server.ID)
+		}
+		refs = append(refs, domain.ID)
+	}
+	refs = append(refs, chain...)
+
+	first, last := obs.ConnectionStart, obs.HandshakeComplete
+	if first.IsZero() {
+		first = obs.seen()
+	}
+	if last.IsZero() || last.Before(first) {
+		last = first
+	}
+	// the capture time, so that the same capture gives the same bundle
+	created := stixTime(obs.seen())
+	observed := &stixObservedData{
+		Type:        "observed-data",
+		SpecVersion: stixSpecVersion,
+		// stable across runs over the same capture
+		ID:             "observed-data--" + uuid5(stixNamespace, obs.connectionID()),
+		Created:        created,
+		Modified:       created,
+		FirstObserved:  stixTime(first),
+		LastObserved:   stixTime(last),
+		NumberObserved: 1,
+		ObjectRefs:     refs,
+	}
+	w.add(observed.ID, observed)
+
+	w.handshakes++
+	if w.handshakes >= stixBundleSize {
+		return w.write()
+	}
+	return nil
+}
+
+func (w *stixWriter) address(ip string) *stixValue {
+	if parsed := net.ParseIP(ip); parsed != nil && parsed.To4() == nil {
+		return w.value("ipv6-addr", ip)
+	}
+	return w.value("ipv4-addr", ip)
+}
+
+// value returns the object of the given type and value, adding it if new.
+func (w *stixWriter) value(typ, value string) *stixValue {
+	id := stixID(typ, map[string]interface{}{"value": value})
+	if v, ok := w.seen[id]; ok {
+		return v.(*stixValue)
+	}
+	v := &stixValue{Type: typ, SpecVersion: stixSpecVersion, ID: id, Value: value}
+	w.add(id, v)
+	return v
+}
+
+func newSTIXCertificate(cert *x509.Certificate) *stixCertificate {
+	sum1 := sha1.Sum(cert.Raw)
+	sum256 := sha256.Sum256(cert.Raw)
+	c := &stixCertificate{
+		Type:        "x509-certificate",
+		SpecVersion: stixSpecVersion,
+		Hashes: map[string]string{
+			"SHA-1":   hex.EncodeToString(sum1[:]),
+			"SHA-256": hex.EncodeToString(sum256[:]),
+		},
+		Version:                   strconv.Itoa(cert.Version),
+		SerialNumber:              colonHex(integerBytes(cert.SerialNumber), false),
+		SignatureAlgorithm:        opensslSignatureAlgorithms[cert.SignatureAlgorithm],
+		Issuer:                    opensslDN(cert.Issuer),
+		ValidityNotBefore:         stixTime(cert.NotBefore),
+		ValidityNotAfter:          stixTime(cert.NotAfter),
+		Subject:                   opensslDN(cert.Subject),
+		SubjectPublicKeyAlgorithm: opensslKeyAlgorithms[cert.PublicKeyAlgorithm],
+	}
+	if key, ok := cert.PublicKey.(*rsa.PublicKey); ok {
+		c.SubjectPublicKeyModulus = hex.EncodeToString(key.N.Bytes())
+		c.SubjectPublicKeyExponent = key.E
+	}
+	c.ID = stixID(c.Type, map[string]interface{}{
+		"hashes":        c.Hashes,
+		"serial_number": c.SerialNumber,
+	})
+	return c
+}
+
+func (w *stixWriter) Close() error {
+	return w.write()
+}
+
+// write writes the current bundle and starts the next one. The bundle's id
+// is derived from the ids of its objects, so the same capture gives the same
+// bundles.
+func (w *stixWriter) write() error {
+	if len(w.objects) == 0 {
+		return nil
+	}
+	raw, err := json.MarshalIndent(&stixBundle{
+		Type:    "bundle",
+		ID:      "bundle--" + uuid5(stixNamespace, digestParts(w.ids...)),
+		Objects: w.objects,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	file := filepath.Join(w.dir, fmt.Sprintf("stix-%04d.json", w.seq+1))
+	if err = w.fs.writeFile(file, raw, 0644); err != nil {
+		// kept, and written with the next bundle
+		return err
+	}
+	w.seq++
+	w.objects, w.ids, w.handshakes = nil, nil, 0
+	w.seen = make(map[string]interface{})
+	return nil
+}
+
+// stixID derives the id of a cyber-observable object from its id contributing
+// properties, serialised as in RFC 8785: sorted keys, no whitespace and no
+// HTML escaping.
+func stixID(typ string, contributing map[string]interface{}) string {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(contributing); err != nil {
+		// only strings, numbers, lists and maps of them
+		panic(err)
+	}
+	return typ + "--" + uuid5(stixNamespace, bytes.TrimSuffix(buf.Bytes(), []byte("\n")))
+}
+
+// uuid5 returns the name based UUID of name in namespace (RFC 4122).
+func uuid5(namespace [16]byte, name []byte) string {
+	h := sha1.New()
+	h.Write(namespace[:])
+	h.Write(name)
+	u := h.Sum(nil)[:16]
+	u[6] = u[6]&0x0f | 0x50
+	u[8] = u[8]&0x3f | 0x80
+	return formatUUID(u)
+}
+
+func formatUUID(u []byte) string {
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16])
+}
+
+func stixTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(stixTimeFormat)
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,149 @@
+package certgrep
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUUID5(t *testing.T) {
+	// the RFC 4122 DNS namespace
+	dns := [16]byte{
+		0x6b, 0xa7, 0xb8, 0x10, 0x9d, 0xad, 0x11, 0xd1,
+		0x80, 0xb4, 0x00, 0xc0, 0x4f, 0xd4, 0x30, 0xc8,
+	}
+	if got, want := uuid5(dns, []byte("python.org")), "886313e1-3b8a-5372-9b90-0c9aee199e5d"; got != want {
+		t.Errorf("uuid5() = %s, want %s", got, want)
+	}
+}
+
+func TestSTIXID(t *testing.T) {
+	// keys are sorted and nothing is HTML escaped, whatever the order given
+	a := stixID("network-traffic", map[string]interface{}{"src_ref": "a", "dst_ref": "b<>", "src_port": 1})
+	b := stixID("network-traffic", map[string]interface{}{"src_port": 1, "dst_ref": "b<>", "src_ref": "a"})
+	if a != b {
+		t.Errorf("ids %s and %s of the same properties", a, b)
+	}
+	if want := "network-traffic--" + uuid5(stixNamespace, []byte(`{"dst_ref":"b<>","src_port":1,"src_ref":"a"}`)); a != want {
+		t.Errorf("stixID() = %s, want %s", a, want)
+	}
+	if c := stixID("network-traffic", map[string]interface{}{"src_ref": "a", "dst_ref": "b<>", "src_port": 2}); c == a {
+		t.Error("same id for different properties")
+	}
+}
+
+// readBundle reads the bundle name written to dir, its objects by id.
+func readBundle(t *testing.T, dir string, name string) (id string, objects map[string]map[string]interface{}) {
+	t.Helper()
+	raw, err := ioutil.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var bundle struct {
+		ID      string                   `json:"id"`
+		Objects []map[string]interface{} `json:"objects"`
+	}
+	if err = json.Unmarshal(raw, &bundle); err != nil {
+		t.Fatal(err)
+	}
+	objects = make(map[string]map[string]interface{})
+	for _, obj := range bundle.Objects {
+		id := obj["id"].(string)
+		if !strings.HasPrefix(id, obj["type"].(string)+"--") {
+			t.Errorf("id %s of a %s", id, obj["type"])
+		}
+		if _, ok := objects[id]; ok {
+			t.Errorf("%s twice in the bundle", id)
+		}
+		objects[id] = obj
+	}
+	return bundle.ID, objects
+}
+
+func TestSTIXWriter(t *testing.T) {
+	obs := stream1Observation(t)
+	obs.ServerName = "www.vxdb.io"
+	other := obs
+	other.Client = "10.0.0.1:51001"
+
+	write := func(observations ...Observation) string {
+		dir := t.TempDir()
+		w := newSTIXWriter(diskFS{}, dir)
+		for _, o := range observations {
+			if err := w.Observe(context.Background(), o); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return dir
+	}
+
+	first, objects := readBundle(t, write(obs, other), "stix-0001.json")
+	second, again := readBundle(t, write(obs, other), "stix-0001.json")
+	if first != second {
+		t.Errorf("bundle ids %s and %s of the same observations", first, second)
+	}
+	for id := range objects {
+		if again[id] == nil {
+			t.Errorf("%s missing from the second bundle", id)
+		}
+	}
+	if third, _ := readBundle(t, write(obs), "stix-0001.json"); third == first {
+		t.Error("same bundle id for different objects")
+	}
+
+	// a certificate, two addresses, a domain, two connections and two
+	// observations
+	types := map[string]int{}
+	for _, obj := range objects {
+		types[obj["type"].(string)]++
+	}
+	want := map[string]int{
+		"x509-certificate": 1,
+		"ipv4-addr":        2,
+		"domain-name":      1,
+		"network-traffic":  2,
+		"observed-data":    2,
+	}
+	for typ, n := range want {
+		if types[typ] != n {
+			t.Errorf("%d %s objects, want %d", types[typ], typ, n)
+		}
+	}
+	observed := "observed-data--" + uuid5(stixNamespace, obs.connectionID())
+	if objects[observed] == nil {
+		t.Errorf("no %s", observed)
+	}
+}
+
+func TestSTIXWriterBundles(t *testing.T) {
+	obs := stream1Observation(t)
+	dir := t.TempDir()
+	w := newSTIXWriter(diskFS{}, dir)
+	for i := 0; i < stixBundleSize+1; i++ {
+		if err := w.Observe(context.Background(), obs); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// every bundle stands on its own, the second one repeats the objects of
+	// the first, and so has the same id
+	first, a := readBundle(t, dir, "stix-0001.json")
+	second, b := readBundle(t, dir, "stix-0002.json")
+	if first != second || len(a) != len(b) {
+		t.Errorf("bundles %s of %d objects and %s of %d", first, len(a), second, len(b))
+	}
+	for id := range a {
+		if b[id] == nil {
+			t.Errorf("%s missing from the second bundle", id)
+		}
+	}
+}
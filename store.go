@@ -0,0 +1,144 @@
+package certgrep
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const (
+	sightingsFile = "sightings.json"
+	// locked while the index of a certificate is updated
+	sightingsLockFile = "sightings.lock"
+)
+
+// store is a persistent, content addressed certificate store meant to be
+// shared between runs. Every certificate is written once, to a directory
+// named after the SHA-256 of its DER encoding, next to an index of where it
+// has been seen.
+//
+//	<dir>/<sha256[0:2]>/<sha256>/cert.pem
+//	<dir>/<sha256[0:2]>/<sha256>/sightings.json
+//
+// Several extractors, in one process or several, can share a store: indexes
+// are updated under a lock.
+type store struct {
+	dir string
+	// sync index files to disk
+	durable bool
+}
+
+// sightings is the per certificate index kept in the store.
+type sightings struct {
+	SHA256    string    `json:"sha256"`
+	SHA1      string    `json:"sha1"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	Count     uint64    `json:"count"`
+	Servers   []string  `json:"servers"`
+	SNI       []string  `json:"sni"`
+	Sources   []string  `json:"sources"`
+}
+
+func newStore(dir string, durable bool) (*store, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(dir, defaultDirPerm); err != nil {
+		return nil, err
+	}
+	return &store{
+		dir:     dir,
+		durable: durable,
+	}, nil
+}
+
+// certDir returns the directory holding the certificate with the given
+// SHA-256 digest.
+func (s *store) certDir(digest string) string {
+	return filepath.Join(s.dir, digest[0:2], digest)
+}
+
+// sight records an observation of a certificate in its index. The index is
+// read, updated and written back while holding the lock of the certificate,
+// so that sightings of other writers aren't lost. Nothing is written unless
+// it succeeds, it can be retried.
+func (s *store) sight(digest, sha1 string, obs Observation) error {
+	dir := s.certDir(digest)
+	if err := os.MkdirAll(dir, defaultDirPerm); err != nil {
+		return err
+	}
+	unlock, err := lockFile(filepath.Join(dir, sightingsLockFile))
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	sg, err := s.load(digest)
+	if err != nil {
+		return err
+	}
+	if sg == nil {
+		sg = &sightings{
+			SHA256:  digest,
+			SHA1:    sha1,
+			Servers: []string{},
+			SNI:     []string{},
+			Sources: []string{},
+		}
+	}
+
+	seen := obs.seen()
+	if sg.FirstSeen.IsZero() || seen.Before(sg.FirstSeen) {
+		sg.FirstSeen = seen
+	}
+	if seen.After(sg.LastSeen) {
+		sg.LastSeen = seen
+	}
+	sg.Count++
+	sg.Servers = addSorted(sg.Servers, obs.Server)
+	sg.SNI = addSorted(sg.SNI, obs.ServerName)
+	sg.Sources = addSorted(sg.Sources, obs.Source)
+
+	raw, err := json.MarshalIndent(sg, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFile(filepath.Join(dir, sightingsFile), raw, 0644, s.durable)
+}
+
+// load reads the index of a certificate, nil if it has never been seen.
+func (s *store) load(digest string) (*sightings, error) {
+	raw, err := ioutil.ReadFile(filepath.Join(s.certDir(digest), sightingsFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sg := &sightings{}
+	if err = json.Unmarshal(raw, sg); err != nil {
+		return nil, err
+	}
+	return sg, nil
+}
+
+// addSorted inserts v into the sorted set list, ignoring empty values.
+func addSorted(list []string, v string) []string {
+	if v == "" {
+		return list
+	}
+	i := sort.SearchStrings(list, v)
+	if i < len(list) && list[i] == v {
+		return list
+	}
+	list = append(list, "")
+	copy(list[i+1:], list[i:])
+	list[i] = v
+	return list
+}
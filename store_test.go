@@ -0,0 +1,111 @@
+package certgrep
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStoreSight(t *testing.T) {
+	s, err := newStore(t.TempDir(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const digest = "5a342128e5aee31646427200353256814a500163387817f62e033418ece5c0c8"
+	if dir := s.certDir(digest); dir != filepath.Join(s.dir, "5a", digest) {
+		t.Errorf("certDir() = %s", dir)
+	}
+
+	seen := time.Date(2015, 4, 3, 7, 49, 20, 0, time.UTC)
+	for _, obs := range []Observation{
+		{Server: "10.0.0.2:443", ServerName: "www.example.com", Source: "a.pcap", CertificateSeen: seen},
+		// earlier, another server
+		{Server: "10.0.0.3:443", Source: "b.pcap", CertificateSeen: seen.Add(-time.Hour)},
+		// no capture time, the processing time counts
+		{Server: "10.0.0.2:443", ServerName: "example.com", Source: "a.pcap", Processed: seen.Add(time.Hour)},
+	} {
+		if err = s.sight(digest, "01d9bd846850aef340c89fbef99186f5c4110ae6", obs); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := s.load(digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &sightings{
+		SHA256:    digest,
+		SHA1:      "01d9bd846850aef340c89fbef99186f5c4110ae6",
+		FirstSeen: seen.Add(-time.Hour),
+		LastSeen:  seen.Add(time.Hour),
+		Count:     3,
+		Servers:   []string{"10.0.0.2:443", "10.0.0.3:443"},
+		SNI:       []string{"example.com", "www.example.com"},
+		Sources:   []string{"a.pcap", "b.pcap"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("sightings = %+v, want %+v", got, want)
+	}
+
+	if sg, err := s.load("00" + digest[2:]); sg != nil || err != nil {
+		t.Errorf("load() of an unknown certificate = %v, %v", sg, err)
+	}
+}
+
+// Several stores on the same directory stand in for several processes, the
+// lock is taken on a file of its own each time.
+func TestStoreSightConcurrent(t *testing.T) {
+	dir := t.TempDir()
+	const (
+		writers = 8
+		each    = 25
+		digest  = "5a342128e5aee31646427200353256814a500163387817f62e033418ece5c0c8"
+	)
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			s, err := newStore(dir, false)
+			if err != nil {
+				errs <- err
+				return
+			}
+			for j := 0; j < each; j++ {
+				obs := Observation{Server: fmt.Sprintf("10.0.0.%d:443", i), Processed: time.Now()}
+				if err = s.sight(digest, "", obs); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	s, _ := newStore(dir, false)
+	sg, err := s.load(digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sg.Count != writers*each || len(sg.Servers) != writers {
+		t.Errorf("count %d and %d servers, want %d and %d", sg.Count, len(sg.Servers), writers*each, writers)
+	}
+}
+
+func TestAddSorted(t *testing.T) {
+	var list []string
+	for _, v := range []string{"b", "", "a", "c", "b", "a"} {
+		list = addSorted(list, v)
+	}
+	if want := []string{"a", "b", "c"}; !reflect.DeepEqual(list, want) {
+		t.Errorf("addSorted() = %v, want %v", list, want)
+	}
+}
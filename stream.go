@@ -0,0 +1,167 @@
+package certgrep
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"time"
+)
+
+// HandshakeError is returned when a TLS handshake ended before the server
+// sent its certificates. Reason is ErrTruncated, ErrTLS13Encrypted,
+// ErrResumedSession, ErrNoServerCertificate, ErrParserBug or nil if the
+// reason isn't known, e.g. for an alert of the server. Err is the error of
+// the handshake.
+type HandshakeError struct {
+	Reason error
+	Err    error
+}
+
+func (e *HandshakeError) Error() string {
+	msg := ErrNoCertificates.Error()
+	if e.Reason != nil {
+		msg += ": " + e.Reason.Error()
+	}
+	if e.Err != nil && !errors.Is(e.Err, e.Reason) {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *HandshakeError) Unwrap() error {
+	return e.Err
+}
+
+// Is makes every HandshakeError match ErrNoCertificates, and its reason.
+func (e *HandshakeError) Is(target error) bool {
+	return target == ErrNoCertificates || (e.Reason != nil && target == e.Reason)
+}
+
+// Meta describes the connection a stream passed to ParseStream was taken
+// from. It is copied to the observation of the result, every field is
+// optional.
+type Meta struct {
+	// ip:port
+	Server     string
+	Client     string
+	ServerName string
+	// of the client hello, if it was seen
+	JA3             string
+	Source          string
+	FlowIndex       uint64
+	ConnectionStart time.Time
+}
+
+// Result is the outcome of ParseStream.
+type Result struct {
+	Observation
+	// what the stream started with: "tls", "proxy" (a PROXY protocol header)
+	// or "starttls" (a plaintext exchange upgraded to TLS)
+	Preamble string
+}
+
+// ParseStream extracts the certificate chain and the handshake parameters
+// from the reassembled server to client side of a connection, as written by
+// a proxy or a TCP reassembler. The stream may start with a PROXY protocol
+// header or a STARTTLS exchange, it is read up to the end of the server's
+// handshake flight.
+//
+// The error is ErrEmptyStream if the stream has no data at all,
+// ErrNoTLSHandshakeFound if it doesn't carry a TLS handshake, ErrClientSide
+// if it is the client's side of one, and matches ErrNoCertificates, as a
+// *HandshakeError, if the handshake ended before the server sent its
+// certificates. In that case the result holds the parameters
+// read up to the error, and the error matches the reason too, e.g.
+// errors.Is(err, ErrTLS13Encrypted).
+func ParseStream(r io.Reader, meta Meta) (*Result, error) {
+	data := bufio.NewReader(r)
+	result := &Result{
+		Observation: Observation{
+			FlowIndex:       meta.FlowIndex,
+			Server:          meta.Server,
+			Client:          meta.Client,
+			ServerName:      meta.ServerName,
+			Source:          meta.Source,
+			JA3:             meta.JA3,
+			ConnectionStart: meta.ConnectionStart,
+		},
+	}
+	v, err := newHandshakeConfig().readHandshake(data, &result.Observation,
+		func() {}, func(string, ...interface{}) {})
+	result.Preamble = v.String()
+	result.Processed = time.Now().UTC()
+	if len(result.Chain) > 0 {
+		// errors after the certificates don't matter
+		return result, nil
+	}
+	if _, ok := err.(*HandshakeError); ok {
+		return result, err
+	}
+	return nil, err
+}
+
+var (
+	hexByteLiteral = regexp.MustCompile(`0[xX]([0-9a-fA-F]{2})`)
+	hexSpace       = regexp.MustCompile(`\s+`)
+	// an array of a Wireshark "C Arrays" dump, peer 0 or 1
+	hexPeerArray = regexp.MustCompile(`\bpeer([01])_\d+\s*\[\]`)
+)
+
+// DecodeHexDump decodes the bytes of a hex dump: either C or Go byte array
+// literals, as exported by Wireshark's "Follow TCP Stream" ("C Arrays"), or
+// plain hex digits, as written by xxd -p. Of a Wireshark dump of both
+// directions, only the arrays of peer 1 are kept: the server, if the capture
+// has the start of the connection. See DecodeHexDumpPeer.
+func DecodeHexDump(dump []byte) ([]byte, error) {
+	return DecodeHexDumpPeer(dump, 1)
+}
+
+// DecodeHexDumpPeer is DecodeHexDump keeping the arrays of the given peer, 0
+// or 1, of a Wireshark "C Arrays" dump. Wireshark numbers the peers in the
+// order they sent their first packet.
+func DecodeHexDumpPeer(dump []byte, peer int) ([]byte, error) {
+	if peer != 0 && peer != 1 {
+		return nil, fmt.Errorf("invalid peer %d", peer)
+	}
+	if arrays := hexPeerArray.FindAllSubmatchIndex(dump, -1); len(arrays) > 0 {
+		var out []byte
+		for i, a := range arrays {
+			if int(dump[a[2]]-'0') != peer {
+				continue
+			}
+			end := len(dump)
+			if i+1 < len(arrays) {
+				end = arrays[i+1][0]
+			}
+			body := dump[a[1]:end]
+			if j := bytes.IndexByte(body, '}'); j >= 0 {
+				body = body[:j]
+			}
+			out = append(out, decodeHexLiterals(body)...)
+		}
+		return out, nil
+	}
+	if literals := decodeHexLiterals(dump); len(literals) > 0 {
+		return literals, nil
+	}
+	digits := hexSpace.ReplaceAll(bytes.TrimSpace(dump), nil)
+	out := make([]byte, hex.DecodedLen(len(digits)))
+	if _, err := hex.Decode(out, digits); err != nil {
+		return nil, fmt.Errorf("invalid hex dump: %w", err)
+	}
+	return out, nil
+}
+
+// decodeHexLiterals decodes the 0x.. byte literals found in dump.
+func decodeHexLiterals(dump []byte) []byte {
+	literals := hexByteLiteral.FindAllSubmatch(dump, -1)
+	out := make([]byte, len(literals))
+	for i, l := range literals {
+		hex.Decode(out[i:i+1], l[1])
+	}
+	return out
+}
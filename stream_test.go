@@ -0,0 +1,117 @@
+package certgrep
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/kung-foo/certgrep/testdata"
+)
+
+// xxdDump formats b as xxd -p does.
+func xxdDump(b []byte) string {
+	var s strings.Builder
+	digits := hex.EncodeToString(b)
+	for len(digits) > 60 {
+		s.WriteString(digits[:60] + "\n")
+		digits = digits[60:]
+	}
+	s.WriteString(digits + "\n")
+	return s.String()
+}
+
+// literals formats b as byte literals, 8 a line.
+func literals(b []byte, format string) string {
+	var s strings.Builder
+	for i, c := range b {
+		if i%8 == 0 {
+			s.WriteString("\n\t")
+		}
+		fmt.Fprintf(&s, format+", ", c)
+	}
+	return s.String()
+}
+
+// wiresharkDump formats the packets of a connection as Wireshark's "Follow
+// TCP Stream" C arrays, peers[i] sent packets[i].
+func wiresharkDump(peers []int, packets ...[]byte) string {
+	var s strings.Builder
+	n := [2]int{}
+	for i, p := range packets {
+		fmt.Fprintf(&s, "char peer%d_%d[] = { /* Packet %d */%s };\n", peers[i], n[peers[i]], i+1, literals(p, "0x%02x"))
+		n[peers[i]]++
+	}
+	return s.String()
+}
+
+func TestDecodeHexDump(t *testing.T) {
+	clientHello := fullClientHello
+	stream := testdata.Stream1
+	split := len(stream1Hello)
+	tests := []struct {
+		name string
+		dump string
+		peer int
+		want []byte
+		err  bool
+	}{
+		{name: "xxd", dump: xxdDump(stream), peer: 1, want: stream},
+		{name: "go", dump: "var stream = []byte{" + literals(stream, "0x%02x") + "\n}\n", peer: 1, want: stream},
+		{name: "upper case", dump: "{" + literals(stream, "0X%02X") + "}", peer: 1, want: stream},
+		{
+			name: "wireshark",
+			dump: wiresharkDump([]int{0, 1, 1}, clientHello, stream[:split], stream[split:]),
+			peer: 1,
+			want: stream,
+		},
+		{
+			name: "wireshark peer 0",
+			dump: wiresharkDump([]int{0, 1, 1}, clientHello, stream[:split], stream[split:]),
+			peer: 0,
+			want: clientHello,
+		},
+		{
+			name: "wireshark single peer",
+			dump: wiresharkDump([]int{1, 1}, stream[:split], stream[split:]),
+			peer: 1,
+			want: stream,
+		},
+		{name: "odd length", dump: "16030", peer: 1, err: true},
+		{name: "not hex", dump: "hello", peer: 1, err: true},
+		{name: "invalid peer", dump: xxdDump(stream), peer: 2, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DecodeHexDumpPeer([]byte(tt.dump), tt.peer)
+			if (err != nil) != tt.err {
+				t.Fatalf("error = %v, want error %v", err, tt.err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("decoded %d bytes, want %d", len(got), len(tt.want))
+			}
+		})
+	}
+}
+
+func TestParseStreamHexDump(t *testing.T) {
+	dump := wiresharkDump([]int{0, 1, 1}, fullClientHello, stream1Hello, testdata.Stream1[len(stream1Hello):])
+	stream, err := DecodeHexDump([]byte(dump))
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := ParseStream(bytes.NewReader(stream), Meta{Server: "10.0.0.2:443", ServerName: "www.vxdb.io"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Chain) != 1 || result.Chain[0].Subject.CommonName != "www.vxdb.io" {
+		t.Fatalf("chain = %v", result.Chain)
+	}
+	if result.Version != 0x0302 || result.CipherSuite != 0xc014 || result.JA3S != "770,49172,65281" {
+		t.Errorf("version %#04x, cipher suite %#04x, JA3S %q", result.Version, result.CipherSuite, result.JA3S)
+	}
+	if result.Server != "10.0.0.2:443" || result.ServerName != "www.vxdb.io" {
+		t.Errorf("meta not copied: server %q, server name %q", result.Server, result.ServerName)
+	}
+}
@@ -0,0 +1,109 @@
+package certgrep
+
+import (
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Summary is what a run of the Extractor processed.
+type Summary struct {
+	// capture timestamps of the first and the last packet
+	FirstPacket time.Time
+	LastPacket  time.Time
+	// wall clock time the run took
+	Elapsed time.Duration
+	Packets int64
+	Bytes   int64
+	// packets of finished or rejected flows, never assembled
+	SkippedPackets uint64
+	SkippedBytes   uint64
+	RejectedFlows  uint64
+	// certificate chains extracted
+	Chains uint64
+	// streams no chain was extracted from
+	Failures HandshakeFailures
+	// writes given up under WriteFailureSkip
+	SkippedWrites uint64
+	// nil unless the packet source keeps statistics
+	Capture *PacketStats
+}
+
+// HandshakeFailures counts the streams no certificate chain was extracted
+// from, by reason, see HandshakeError.
+type HandshakeFailures struct {
+	// ErrNoTLSHandshakeFound
+	NotTLS    uint64
+	Truncated uint64
+	TLS13     uint64
+	Resumed   uint64
+	// ErrNoServerCertificate
+	NoCertificate uint64
+	ParserBug     uint64
+	// handshakes that failed for another reason, e.g. an alert
+	Other uint64
+}
+
+// add counts the error of a stream.
+func (f *HandshakeFailures) add(err error) {
+	switch failureKind(err) {
+	case failureNotTLS:
+		f.NotTLS++
+	case failureTruncated:
+		f.Truncated++
+	case failureTLS13:
+		f.TLS13++
+	case failureResumed:
+		f.Resumed++
+	case failureNoCert:
+		f.NoCertificate++
+	case failureParserBug:
+		f.ParserBug++
+	default:
+		f.Other++
+	}
+}
+
+// CaptureTime is the time between the first and the last packet.
+func (s Summary) CaptureTime() time.Duration {
+	return s.LastPacket.Sub(s.FirstPacket)
+}
+
+// BitRate is the average rate of the capture, in bits per second.
+func (s Summary) BitRate() float64 {
+	return 8 * float64(s.Bytes) / s.CaptureTime().Seconds()
+}
+
+func (s Summary) log(logger *zap.SugaredLogger, prefilter bool) {
+	logger.Infof("capture time: %.f seconds", s.CaptureTime().Seconds())
+	logger.Infof("capture size: %d bytes", s.Bytes)
+
+	bps := s.BitRate()
+	if bps < 1024*1024 {
+		logger.Infof("average capture rate: %.3f Kbit/s", bps/1024)
+	} else if bps < 1024*1024*1024 {
+		logger.Infof("average capture rate: %.3f Mbit/s", bps/(1024*1024))
+	} else {
+		logger.Infof("average capture rate: %.3f Gbit/s", bps/(1024*1024*1024))
+	}
+	logger.Infof("pps: %.f", float64(s.Packets)/s.Elapsed.Seconds())
+
+	logger.Infof("skipped: %d bytes (%d packets) from finished flows", s.SkippedBytes, s.SkippedPackets)
+	if prefilter {
+		logger.Infof("rejected flows: %d", s.RejectedFlows)
+	}
+	logger.Infof("chains: %d", s.Chains)
+	f := s.Failures
+	logger.Infof("no chain: not tls: %d, truncated: %d, tls 1.3: %d, resumed: %d, no certificate: %d, parser bug: %d, other: %d",
+		f.NotTLS, f.Truncated, f.TLS13, f.Resumed, f.NoCertificate, f.ParserBug, f.Other)
+	if f.ParserBug > 0 {
+		logger.Warnf("parser bugs: %d", f.ParserBug)
+	}
+	if s.Capture != nil {
+		logger.Infof("received: %d packets, dropped: %d (%d by the interface)",
+			s.Capture.PacketsReceived, s.Capture.PacketsDropped, s.Capture.PacketsIfDropped)
+	}
+	if s.SkippedWrites > 0 {
+		logger.Warnf("skipped writes: %d", s.SkippedWrites)
+	}
+}
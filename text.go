@@ -0,0 +1,331 @@
+package certgrep
+
+import (
+	"context"
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const textTimeFormat = "Jan _2 15:04:05 2006 GMT"
+
+// Names used by openssl x509 -text.
+var (
+	textExtensionNames = map[string]string{
+		"2.5.29.14":               "X509v3 Subject Key Identifier",
+		"2.5.29.15":               "X509v3 Key Usage",
+		"2.5.29.17":               "X509v3 Subject Alternative Name",
+		"2.5.29.18":               "X509v3 Issuer Alternative Name",
+		"2.5.29.19":               "X509v3 Basic Constraints",
+		"2.5.29.30":               "X509v3 Name Constraints",
+		"2.5.29.31":               "X509v3 CRL Distribution Points",
+		"2.5.29.32":               "X509v3 Certificate Policies",
+		"2.5.29.33":               "X509v3 Policy Mappings",
+		"2.5.29.35":               "X509v3 Authority Key Identifier",
+		"2.5.29.36":               "X509v3 Policy Constraints",
+		"2.5.29.37":               "X509v3 Extended Key Usage",
+		"2.5.29.54":               "X509v3 Inhibit Any Policy",
+		"1.3.6.1.5.5.7.1.1":       "Authority Information Access",
+		"1.3.6.1.5.5.7.1.11":      "Subject Information Access",
+		"1.3.6.1.5.5.7.1.24":      "TLS Feature",
+		"1.3.6.1.4.1.11129.2.4.2": "CT Precertificate SCTs",
+		"1.3.6.1.4.1.11129.2.4.3": "CT Precertificate Poison",
+		"2.16.840.1.113730.1.1":   "Netscape Cert Type",
+		"2.16.840.1.113730.1.13":  "Netscape Comment",
+	}
+
+	textKeyUsageNames = []struct {
+		usage x509.KeyUsage
+		name  string
+	}{
+		{x509.KeyUsageDigitalSignature, "Digital Signature"},
+		{x509.KeyUsageContentCommitment, "Non Repudiation"},
+		{x509.KeyUsageKeyEncipherment, "Key Encipherment"},
+		{x509.KeyUsageDataEncipherment, "Data Encipherment"},
+		{x509.KeyUsageKeyAgreement, "Key Agreement"},
+		{x509.KeyUsageCertSign, "Certificate Sign"},
+		{x509.KeyUsageCRLSign, "CRL Sign"},
+		{x509.KeyUsageEncipherOnly, "Encipher Only"},
+		{x509.KeyUsageDecipherOnly, "Decipher Only"},
+	}
+
+	textExtKeyUsageNames = map[x509.ExtKeyUsage]string{
+		x509.ExtKeyUsageAny:                            "Any Extended Key Usage",
+		x509.ExtKeyUsageServerAuth:                     "TLS Web Server Authentication",
+		x509.ExtKeyUsageClientAuth:                     "TLS Web Client Authentication",
+		x509.ExtKeyUsageCodeSigning:                    "Code Signing",
+		x509.ExtKeyUsageEmailProtection:                "E-mail Protection",
+		x509.ExtKeyUsageIPSECEndSystem:                 "IPSec End System",
+		x509.ExtKeyUsageIPSECTunnel:                    "IPSec Tunnel",
+		x509.ExtKeyUsageIPSECUser:                      "IPSec User",
+		x509.ExtKeyUsageTimeStamping:                   "Time Stamping",
+		x509.ExtKeyUsageOCSPSigning:                    "OCSP Signing",
+		x509.ExtKeyUsageMicrosoftServerGatedCrypto:     "Microsoft Server Gated Crypto",
+		x509.ExtKeyUsageNetscapeServerGatedCrypto:      "Netscape Server Gated Crypto",
+		x509.ExtKeyUsageMicrosoftCommercialCodeSigning: "Microsoft Commercial Code Signing",
+		x509.ExtKeyUsageMicrosoftKernelCodeSigning:     "Microsoft Kernel Code Signing",
+	}
+)
+
+// certificateText renders cert like openssl x509 -text.
+func certificateText(cert *x509.Certificate) string {
+	var b strings.Builder
+	p := func(indent int, format string, args ...interface{}) {
+		b.WriteString(strings.Repeat(" ", indent))
+		fmt.Fprintf(&b, format, args...)
+		b.WriteByte('\n')
+	}
+
+	sigAlg := opensslSignatureAlgorithms[cert.SignatureAlgorithm]
+	if sigAlg == "" {
+		sigAlg = cert.SignatureAlgorithm.String()
+	}
+
+	p(0, "Certificate:")
+	p(4, "Data:")
+	p(8, "Version: %d (0x%x)", cert.Version, cert.Version-1)
+	p(8, "Serial Number: %s (0x%s)", cert.SerialNumber, cert.SerialNumber.Text(16))
+	p(8, "Signature Algorithm: %s", sigAlg)
+	p(8, "Issuer: %s", opensslDN(cert.Issuer))
+	p(8, "Validity")
+	p(12, "Not Before: %s", cert.NotBefore.UTC().Format(textTimeFormat))
+	p(12, "Not After : %s", cert.NotAfter.UTC().Format(textTimeFormat))
+	p(8, "Subject: %s", opensslDN(cert.Subject))
+	p(8, "Subject Public Key Info:")
+
+	keyAlg := opensslKeyAlgorithms[cert.PublicKeyAlgorithm]
+	if keyAlg == "" {
+		keyAlg = cert.PublicKeyAlgorithm.String()
+	}
+	p(12, "Public Key Algorithm: %s", keyAlg)
+	switch key := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		p(16, "RSA Public-Key: (%d bit)", key.N.BitLen())
+		p(16, "Modulus:")
+		b.WriteString(hexBlock(integerBytes(key.N), 15, 20))
+		p(16, "Exponent: %d (0x%x)", key.E, key.E)
+	case *ecdsa.PublicKey:
+		p(16, "Public-Key: (%d bit)", key.Params().BitSize)
+		p(16, "pub:")
+		b.WriteString(hexBlock(elliptic.Marshal(key.Curve, key.X, key.Y), 15, 20))
+		if oid := opensslCurves[key.Params().Name]; oid != "" {
+			p(16, "ASN1 OID: %s", oid)
+		}
+		p(16, "NIST CURVE: %s", key.Params().Name)
+	case ed25519.PublicKey:
+		p(16, "ED25519 Public-Key:")
+		p(16, "pub:")
+		b.WriteString(hexBlock(key, 15, 20))
+	case *dsa.PublicKey:
+		p(16, "Public-Key: (%d bit)", key.P.BitLen())
+		for _, v := range []struct {
+			name string
+			b    []byte
+		}{
+			{"pub", integerBytes(key.Y)},
+			{"P", integerBytes(key.P)},
+			{"Q", integerBytes(key.Q)},
+			{"G", integerBytes(key.G)},
+		} {
+			p(16, "%s:", v.name)
+			b.WriteString(hexBlock(v.b, 15, 20))
+		}
+	default:
+		p(16, "Unable to load Public Key")
+	}
+
+	if len(cert.Extensions) > 0 {
+		p(8, "X509v3 extensions:")
+	}
+	for _, ext := range cert.Extensions {
+		oid := ext.Id.String()
+		name := textExtensionNames[oid]
+		if name == "" {
+			name = oid
+		}
+		if ext.Critical {
+			p(12, "%s: critical", name)
+		} else {
+			p(12, "%s: ", name)
+		}
+		for _, line := range extensionText(cert, oid, ext.Value) {
+			if line == "" {
+				b.WriteByte('\n')
+				continue
+			}
+			p(16, "%s", line)
+		}
+	}
+
+	p(4, "Signature Algorithm: %s", sigAlg)
+	b.WriteString(hexBlock(cert.Signature, 18, 9))
+	return b.String()
+}
+
+// extensionText decodes an extension, relying on the fields x509 already
+// parsed. Extensions x509 doesn't know are dumped in hex.
+func extensionText(cert *x509.Certificate, oid string, value []byte) []string {
+	switch oid {
+	case "2.5.29.19":
+		if !cert.IsCA {
+			return []string{"CA:FALSE"}
+		}
+		if cert.MaxPathLen > 0 || cert.MaxPathLenZero {
+			return []string{fmt.Sprintf("CA:TRUE, pathlen:%d", cert.MaxPathLen)}
+		}
+		return []string{"CA:TRUE"}
+	case "2.5.29.15":
+		var usages []string
+		for _, ku := range textKeyUsageNames {
+			if cert.KeyUsage&ku.usage != 0 {
+				usages = append(usages, ku.name)
+			}
+		}
+		return []string{strings.Join(usages, ", ")}
+	case "2.5.29.37":
+		var usages []string
+		for _, eku := range cert.ExtKeyUsage {
+			usages = append(usages, textExtKeyUsageNames[eku])
+		}
+		for _, unknown := range cert.UnknownExtKeyUsage {
+			usages = append(usages, unknown.String())
+		}
+		return []string{strings.Join(usages, ", ")}
+	case "2.5.29.14":
+		return []string{colonHex(cert.SubjectKeyId, true)}
+	case "2.5.29.35":
+		return []string{"keyid:" + colonHex(cert.AuthorityKeyId, true)}
+	case "2.5.29.17":
+		var names []string
+		for _, name := range cert.DNSNames {
+			names = append(names, "DNS:"+name)
+		}
+		for _, ip := range cert.IPAddresses {
+			names = append(names, "IP Address:"+ip.String())
+		}
+		for _, email := range cert.EmailAddresses {
+			names = append(names, "email:"+email)
+		}
+		for _, uri := range cert.URIs {
+			names = append(names, "URI:"+uri.String())
+		}
+		return []string{strings.Join(names, ", ")}
+	case "2.5.29.31":
+		var lines []string
+		for _, dp := range cert.CRLDistributionPoints {
+			lines = append(lines, "", "Full Name:", "  URI:"+dp)
+		}
+		return lines
+	case "2.5.29.32":
+		var lines []string
+		for _, policy := range cert.PolicyIdentifiers {
+			lines = append(lines, "Policy: "+policy.String())
+		}
+		return lines
+	case "1.3.6.1.5.5.7.1.1":
+		var lines []string
+		for _, ocsp := range cert.OCSPServer {
+			lines = append(lines, "OCSP - URI:"+ocsp)
+		}
+		for _, issuer := range cert.IssuingCertificateURL {
+			lines = append(lines, "CA Issuers - URI:"+issuer)
+		}
+		return lines
+	case "2.5.29.30":
+		var lines []string
+		permitted := constraintNames(cert.PermittedDNSDomains, cert.PermittedEmailAddresses,
+			cert.PermittedURIDomains)
+		for _, ipnet := range cert.PermittedIPRanges {
+			permitted = append(permitted, "IP:"+ipnet.String())
+		}
+		excluded := constraintNames(cert.ExcludedDNSDomains, cert.ExcludedEmailAddresses,
+			cert.ExcludedURIDomains)
+		for _, ipnet := range cert.ExcludedIPRanges {
+			excluded = append(excluded, "IP:"+ipnet.String())
+		}
+		if len(permitted) > 0 {
+			lines = append(lines, "Permitted:")
+			for _, name := range permitted {
+				lines = append(lines, "  "+name)
+			}
+		}
+		if len(excluded) > 0 {
+			lines = append(lines, "Excluded:")
+			for _, name := range excluded {
+				lines = append(lines, "  "+name)
+			}
+		}
+		return lines
+	}
+	return strings.Split(strings.TrimRight(hexBlock(value, 18, 0), "\n"), "\n")
+}
+
+func constraintNames(dns, emails, uris []string) []string {
+	var names []string
+	for _, name := range dns {
+		names = append(names, "DNS:"+name)
+	}
+	for _, email := range emails {
+		names = append(names, "email:"+email)
+	}
+	for _, uri := range uris {
+		names = append(names, "URI:"+uri)
+	}
+	return names
+}
+
+// hexBlock formats b as lowercase colon separated hex, perLine bytes per
+// line, like openssl does for keys and signatures.
+func hexBlock(b []byte, perLine, indent int) string {
+	var s strings.Builder
+	for i := 0; i < len(b); i += perLine {
+		end := i + perLine
+		if end > len(b) {
+			end = len(b)
+		}
+		s.WriteString(strings.Repeat(" ", indent))
+		s.WriteString(colonHex(b[i:end], false))
+		if end < len(b) {
+			s.WriteByte(':')
+		}
+		s.WriteByte('\n')
+	}
+	return s.String()
+}
+
+// textWriter prints the chains of a single flow to a terminal. The flow is
+// selected by its index, its hash or the server's ip:port.
+type textWriter struct {
+	flow string
+	w    io.Writer
+}
+
+func (w *textWriter) matches(obs Observation) bool {
+	return w.flow == strconv.FormatUint(obs.FlowIndex, 10) ||
+		w.flow == obs.FlowHash ||
+		w.flow == obs.Server
+}
+
+func (w *textWriter) Observe(_ context.Context, obs Observation) error {
+	if !w.matches(obs) {
+		return nil
+	}
+	for i, cert := range obs.Chain {
+		_, err := fmt.Fprintf(w.w, "# %s cert:%d\n%s\n", obs.logPrefix(), i, certificateText(cert))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *textWriter) Close() error {
+	return nil
+}
@@ -9,7 +9,6 @@ import (
 	"crypto"
 	"crypto/rand"
 	"crypto/x509"
-	"fmt"
 	"io"
 	"math/big"
 	"strings"
@@ -343,6 +342,11 @@ type Config struct {
 	// be used.
 	CurvePreferences []CurveID
 
+	// PeerCertificatesHook, if not nil, is called by a client as soon as the
+	// server's certificates have been parsed, before the rest of the
+	// handshake is read. (certgrep)
+	PeerCertificatesHook func(certs []*x509.Certificate)
+
 	serverInitOnce sync.Once // guards calling (*Config).serverInit
 }
 
@@ -617,5 +621,5 @@ func initDefaultCipherSuites() {
 }
 
 func unexpectedMessageError(wanted, got interface{}) error {
-	return fmt.Errorf("tls: received unexpected handshake message of type %T when waiting for %T", got, wanted)
+	return &unexpectedMessage{wanted: wanted, got: got}
 }
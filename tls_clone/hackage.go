@@ -1,7 +1,34 @@
 package tls
 
-import "crypto/x509"
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+)
 
 func (c *Conn) PeerCertificates() []*x509.Certificate {
 	return c.peerCertificates
 }
+
+// ErrUnexpectedMessage is matched, with errors.Is, by the errors of
+// handshakes a message or a record came out of order in, and by
+// unexpected_message alerts.
+var ErrUnexpectedMessage = errors.New("tls: unexpected message")
+
+// unexpectedMessage is the error of a handshake message that isn't the one
+// the handshake waited for.
+type unexpectedMessage struct {
+	wanted, got interface{}
+}
+
+func (e *unexpectedMessage) Error() string {
+	return fmt.Sprintf("tls: received unexpected handshake message of type %T when waiting for %T", e.got, e.wanted)
+}
+
+func (e *unexpectedMessage) Is(target error) bool {
+	return target == ErrUnexpectedMessage
+}
+
+func (e alert) Is(target error) bool {
+	return e == alertUnexpectedMessage && target == ErrUnexpectedMessage
+}
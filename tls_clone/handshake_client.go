@@ -276,6 +276,10 @@ func (hs *clientHandshakeState) doFullHandshake() error {
 
 	c.peerCertificates = certs
 
+	if c.config.PeerCertificatesHook != nil {
+		c.config.PeerCertificatesHook(certs)
+	}
+
 	if hs.serverHello.ocspStapling {
 		msg, err = c.readHandshake()
 		if err != nil {
@@ -0,0 +1,293 @@
+package certgrep
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// chains per POST, smaller batches are sent on every flush
+	webhookBatchSize = 100
+	// batches waiting for the sender, more are spooled right away
+	webhookQueueSize = 16
+	webhookTimeout   = 30 * time.Second
+	// wait before retrying an unavailable endpoint, doubled up to the maximum
+	webhookRetryWait    = time.Second
+	webhookMaxRetryWait = 5 * time.Minute
+	webhookContentType  = "application/x-ndjson"
+	webhookSpoolSuffix  = ".ndjson"
+	// in the spool, batches the collector refused
+	webhookRejectedDir = "rejected"
+)
+
+// webhookRejectedError is returned for batches the collector refused as
+// malformed or too large, sending them again won't help.
+type webhookRejectedError struct {
+	status string
+}
+
+func (e *webhookRejectedError) Error() string {
+	return "batch rejected: " + e.status
+}
+
+// webhookWriter POSTs the JSON Lines events of the chains, in batches, to an
+// HTTP collector. Batches are sent by a goroutine of their own, so that a
+// slow or unavailable collector doesn't hold up the output. Batches that
+// can't be delivered are spooled to disk and retried, with backoff, until the
+// collector accepts them again, also by later runs using the same spool.
+// Batches refused as malformed or too large are moved to rejected/ in the
+// spool instead, so that they don't hold up the others.
+type webhookWriter struct {
+	// names spooled batches, in order, used by both goroutines. First for
+	// 64 bit alignment.
+	seq uint64
+
+	url    string
+	header http.Header
+	spool  string
+	client *http.Client
+	logger *zap.SugaredLogger
+
+	batch   bytes.Buffer
+	pending int
+	batches chan []byte
+	// signals the sender that flush spooled a batch
+	spooled chan struct{}
+	done    chan struct{}
+}
+
+func newWebhookWriter(url string, header http.Header, spool string, logger *zap.SugaredLogger) (*webhookWriter, error) {
+	if err := os.MkdirAll(spool, defaultDirPerm); err != nil {
+		return nil, err
+	}
+	w := &webhookWriter{
+		url:     url,
+		header:  header,
+		spool:   spool,
+		client:  &http.Client{Timeout: webhookTimeout},
+		logger:  logger,
+		batches: make(chan []byte, webhookQueueSize),
+		spooled: make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	go w.send()
+	return w, nil
+}
+
+func (w *webhookWriter) Observe(_ context.Context, obs Observation) error {
+	if err := writeEvents(&w.batch, obs); err != nil {
+		return err
+	}
+	w.pending++
+	if w.pending >= webhookBatchSize {
+		return w.flush()
+	}
+	return nil
+}
+
+// flush hands the current batch to the sender, or spools it if the sender is
+// behind and lets the sender know.
+func (w *webhookWriter) flush() error {
+	if w.pending == 0 {
+		return nil
+	}
+	batch := append([]byte(nil), w.batch.Bytes()...)
+	w.batch.Reset()
+	w.pending = 0
+
+	select {
+	case w.batches <- batch:
+		return nil
+	default:
+	}
+	if err := w.spoolBatch(batch); err != nil {
+		return err
+	}
+	select {
+	case w.spooled <- struct{}{}:
+	default:
+		// already signalled
+	}
+	return nil
+}
+
+func (w *webhookWriter) Close() error {
+	err := w.flush()
+	close(w.batches)
+	<-w.done
+	return err
+}
+
+// send delivers batches until the writer is closed. After a failed POST the
+// endpoint is considered down: batches go to the spool until a retry of the
+// spooled ones succeeds. Batches flush spooled while the endpoint is up are
+// delivered right away, and the spool is drained once more on close.
+func (w *webhookWriter) send() {
+	defer close(w.done)
+
+	wait := webhookRetryWait
+	// deliver what earlier runs left behind first
+	retry := time.NewTimer(0)
+	down := true
+	defer retry.Stop()
+
+	for {
+		select {
+		case batch, ok := <-w.batches:
+			if !ok {
+				// a last try, so that short runs deliver too, and what was
+				// spooled since the last drain isn't left for the next run
+				if err := w.drain(); err != nil {
+					w.logger.Warnf("collector unavailable, batches left in %s: %v", w.spool, err)
+				}
+				return
+			}
+			if !down {
+				err := w.post(batch)
+				if err == nil {
+					continue
+				}
+				if _, ok := err.(*webhookRejectedError); ok {
+					if err = w.reject(batch); err != nil {
+						w.logger.Errorf("spooling rejected batch: %v", err)
+					}
+					continue
+				}
+				w.logger.Warnf("collector unavailable, spooling: %v", err)
+				down = true
+				wait = webhookRetryWait
+				retry.Reset(wait)
+			}
+			if err := w.spoolBatch(batch); err != nil {
+				w.logger.Errorf("spooling batch: %v", err)
+			}
+		case <-w.spooled:
+			if down {
+				// delivered by the next retry
+				continue
+			}
+			if err := w.drain(); err != nil {
+				w.logger.Warnf("collector unavailable, spooling: %v", err)
+				down = true
+				wait = webhookRetryWait
+				retry.Reset(wait)
+			}
+		case <-retry.C:
+			if err := w.drain(); err != nil {
+				wait *= 2
+				if wait > webhookMaxRetryWait {
+					wait = webhookMaxRetryWait
+				}
+				w.logger.Debugf("collector still unavailable, retrying in %s: %v", wait, err)
+				retry.Reset(wait)
+				continue
+			}
+			down = false
+		}
+	}
+}
+
+// drain sends the spooled batches, oldest first, removing each once
+// delivered.
+func (w *webhookWriter) drain() error {
+	files, err := ioutil.ReadDir(w.spool)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(files))
+	for _, f := range files {
+		// skips temporary files of unfinished writes
+		if f.Mode().IsRegular() && strings.HasSuffix(f.Name(), webhookSpoolSuffix) &&
+			!strings.HasPrefix(f.Name(), ".") {
+			names = append(names, f.Name())
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		path := filepath.Join(w.spool, name)
+		batch, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if err = w.post(batch); err != nil {
+			if _, ok := err.(*webhookRejectedError); !ok {
+				return err
+			}
+			if err = w.reject(batch); err != nil {
+				return err
+			}
+		}
+		if err = os.Remove(path); err != nil {
+			return err
+		}
+	}
+	if len(names) > 0 {
+		w.logger.Infof("delivered %d spooled batches", len(names))
+	}
+	return nil
+}
+
+// spoolBatch writes a batch to the spool. Names sort in the order batches
+// were spooled.
+func (w *webhookWriter) spoolBatch(batch []byte) error {
+	seq := atomic.AddUint64(&w.seq, 1)
+	name := fmt.Sprintf("%020d-%06d%s", time.Now().UnixNano(), seq%1000000, webhookSpoolSuffix)
+	return writeFile(filepath.Join(w.spool, name), batch, 0600, true)
+}
+
+// reject moves a batch the collector refused out of the way, to rejected/ in
+// the spool, where it is kept for inspection but never sent again.
+func (w *webhookWriter) reject(batch []byte) error {
+	dir := filepath.Join(w.spool, webhookRejectedDir)
+	if err := os.MkdirAll(dir, defaultDirPerm); err != nil {
+		return err
+	}
+	seq := atomic.AddUint64(&w.seq, 1)
+	name := fmt.Sprintf("%020d-%06d%s", time.Now().UnixNano(), seq%1000000, webhookSpoolSuffix)
+	w.logger.Warnf("collector rejected a batch, moved to %s", filepath.Join(dir, name))
+	return writeFile(filepath.Join(dir, name), batch, 0600, true)
+}
+
+func (w *webhookWriter) post(batch []byte) error {
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(batch))
+	if err != nil {
+		return err
+	}
+	for name, values := range w.header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", webhookContentType)
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge,
+		http.StatusUnsupportedMediaType, http.StatusUnprocessableEntity:
+		// the batch itself is at fault
+		return &webhookRejectedError{status: resp.Status}
+	case http.StatusUnauthorized, http.StatusForbidden:
+		// batches are kept until the credentials are fixed
+		w.logger.Errorf("collector refused the credentials, batches are spooled until it accepts them: %s", resp.Status)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s: %s", w.url, resp.Status)
+	}
+	return nil
+}
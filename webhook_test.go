@@ -0,0 +1,282 @@
+package certgrep
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kung-foo/certgrep/testdata"
+	"go.uber.org/zap"
+)
+
+// collector is an HTTP endpoint answering with the statuses it is given, in
+// turn, the last one repeated.
+type collector struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	statuses []int
+	batches  [][]byte
+	headers  []http.Header
+}
+
+func newCollector(statuses ...int) *collector {
+	c := &collector{statuses: statuses}
+	c.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		c.mu.Lock()
+		status := c.statuses[0]
+		if len(c.statuses) > 1 {
+			c.statuses = c.statuses[1:]
+		}
+		if status == http.StatusOK {
+			c.batches = append(c.batches, body)
+			c.headers = append(c.headers, r.Header)
+		}
+		c.mu.Unlock()
+		w.WriteHeader(status)
+	}))
+	return c
+}
+
+// delivered returns the batches accepted so far, concatenated.
+func (c *collector) delivered() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return bytes.Join(c.batches, nil)
+}
+
+func stream1Observation(t *testing.T) Observation {
+	t.Helper()
+	result, err := ParseStream(bytes.NewReader(testdata.Stream1), Meta{
+		FlowIndex: 1,
+		Server:    "10.0.0.2:443",
+		Client:    "10.0.0.1:51000",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result.Processed = time.Date(2020, 2, 1, 0, 0, 0, 0, time.UTC)
+	return result.Observation
+}
+
+// spooled lists the batches waiting in the spool and those rejected.
+func spooled(t *testing.T, spool string) (pending, rejected []string) {
+	t.Helper()
+	var err error
+	if pending, err = filepath.Glob(filepath.Join(spool, "*"+webhookSpoolSuffix)); err != nil {
+		t.Fatal(err)
+	}
+	if rejected, err = filepath.Glob(filepath.Join(spool, webhookRejectedDir, "*"+webhookSpoolSuffix)); err != nil {
+		t.Fatal(err)
+	}
+	return pending, rejected
+}
+
+// sendBatch writes an observation through a webhookWriter, closing it once the
+// collector holds want, or right away if want is nil.
+func sendBatch(t *testing.T, c *collector, spool string, obs Observation, want []byte) {
+	t.Helper()
+	header := http.Header{"Authorization": {"Bearer token"}}
+	w, err := newWebhookWriter(c.URL, header, spool, zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Observe(context.Background(), obs); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if want != nil {
+		deadline := time.Now().Add(10 * webhookRetryWait)
+		for !bytes.Equal(c.delivered(), want) && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	obs := stream1Observation(t)
+	var events bytes.Buffer
+	if err := writeEvents(&events, obs); err != nil {
+		t.Fatal(err)
+	}
+	batch := events.Bytes()
+
+	tests := []struct {
+		name     string
+		statuses []int
+		// wait for the collector to accept this much
+		wait      []byte
+		delivered []byte
+		pending   int
+		rejected  int
+	}{
+		{name: "delivered", statuses: []int{http.StatusOK}, delivered: batch},
+		{
+			name:     "unavailable",
+			statuses: []int{http.StatusServiceUnavailable},
+			pending:  1,
+		},
+		{
+			name:     "rate limited",
+			statuses: []int{http.StatusTooManyRequests},
+			pending:  1,
+		},
+		{
+			name:     "rejected",
+			statuses: []int{http.StatusBadRequest},
+			rejected: 1,
+		},
+		{
+			name:     "too large",
+			statuses: []int{http.StatusRequestEntityTooLarge},
+			rejected: 1,
+		},
+		{
+			// kept until the credentials are fixed
+			name:     "unauthorized",
+			statuses: []int{http.StatusUnauthorized},
+			pending:  1,
+		},
+		{
+			name:     "forbidden",
+			statuses: []int{http.StatusForbidden},
+			pending:  1,
+		},
+		{
+			name:     "not found",
+			statuses: []int{http.StatusNotFound},
+			pending:  1,
+		},
+		{
+			// the retry of the spooled batch succeeds within the run
+			name:      "retried",
+			statuses:  []int{http.StatusServiceUnavailable, http.StatusOK},
+			wait:      batch,
+			delivered: batch,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newCollector(tt.statuses...)
+			defer c.Close()
+			spool := t.TempDir()
+
+			sendBatch(t, c, spool, obs, tt.wait)
+
+			if got := c.delivered(); !bytes.Equal(got, tt.delivered) {
+				t.Errorf("delivered %q, want %q", got, tt.delivered)
+			}
+			pending, rejected := spooled(t, spool)
+			if len(pending) != tt.pending || len(rejected) != tt.rejected {
+				t.Errorf("%d batches spooled and %d rejected, want %d and %d",
+					len(pending), len(rejected), tt.pending, tt.rejected)
+			}
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			for _, h := range c.headers {
+				if h.Get("Authorization") != "Bearer token" || h.Get("Content-Type") != webhookContentType {
+					t.Errorf("headers %v", h)
+				}
+			}
+		})
+	}
+}
+
+func TestWebhookSpoolDeliveredByNextRun(t *testing.T) {
+	obs := stream1Observation(t)
+	var events bytes.Buffer
+	if err := writeEvents(&events, obs); err != nil {
+		t.Fatal(err)
+	}
+	spool := t.TempDir()
+
+	rejecting := newCollector(http.StatusUnprocessableEntity)
+	sendBatch(t, rejecting, spool, obs, nil)
+	rejecting.Close()
+	down := newCollector(http.StatusServiceUnavailable)
+	sendBatch(t, down, spool, obs, nil)
+	down.Close()
+	if pending, rejected := spooled(t, spool); len(pending) != 1 || len(rejected) != 1 {
+		t.Fatalf("%d batches spooled and %d rejected, want 1 and 1", len(pending), len(rejected))
+	}
+
+	// the spooled batch is delivered along with the new one, the rejected one
+	// stays where it is
+	up := newCollector(http.StatusOK)
+	defer up.Close()
+	sendBatch(t, up, spool, obs, nil)
+	if got, want := up.delivered(), bytes.Repeat(events.Bytes(), 2); !bytes.Equal(got, want) {
+		t.Errorf("delivered %q, want %q", got, want)
+	}
+	if pending, rejected := spooled(t, spool); len(pending) != 0 || len(rejected) != 1 {
+		t.Errorf("%d batches spooled and %d rejected, want 0 and 1", len(pending), len(rejected))
+	}
+}
+
+func TestWebhookOverflowDeliveredWithinRun(t *testing.T) {
+	obs := stream1Observation(t)
+	var (
+		mu       sync.Mutex
+		received int
+	)
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		ioutil.ReadAll(r.Body)
+		mu.Lock()
+		received++
+		mu.Unlock()
+	}))
+	defer srv.Close()
+	spool := t.TempDir()
+
+	w, err := newWebhookWriter(srv.URL, nil, spool, zap.NewNop().Sugar())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the sender holds a batch, the queue fills up and the rest is spooled
+	const batches = webhookQueueSize + 4
+	for i := 0; i < batches; i++ {
+		if err = w.Observe(context.Background(), obs); err != nil {
+			t.Fatal(err)
+		}
+		if err = w.flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if pending, _ := spooled(t, spool); len(pending) == 0 {
+		t.Fatal("nothing spooled")
+	}
+	close(release)
+
+	// delivered before Close
+	deadline := time.Now().Add(10 * webhookRetryWait)
+	for {
+		mu.Lock()
+		n := received
+		mu.Unlock()
+		pending, _ := spooled(t, spool)
+		if n == batches && len(pending) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d batches delivered and %d spooled, want %d and 0", n, len(pending), batches)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,470 @@
+package certgrep
+
+import (
+	"bufio"
+	"context"
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	zeekSetSeparator = ","
+	zeekEmptyField   = "(empty)"
+	zeekUnsetField   = "-"
+	zeekTimeFormat   = "2006-01-02-15-04-05"
+)
+
+type zeekField struct {
+	name string
+	typ  string
+}
+
+// Fields of ssl.log and x509.log, in the order of Zeek's base scripts.
+var (
+	zeekSSLFields = []zeekField{
+		{"ts", "time"},
+		{"uid", "string"},
+		{"id.orig_h", "addr"},
+		{"id.orig_p", "port"},
+		{"id.resp_h", "addr"},
+		{"id.resp_p", "port"},
+		{"version", "string"},
+		{"cipher", "string"},
+		{"curve", "string"},
+		{"server_name", "string"},
+		{"resumed", "bool"},
+		{"last_alert", "string"},
+		{"next_protocol", "string"},
+		{"established", "bool"},
+		{"cert_chain_fuids", "vector[string]"},
+		{"client_cert_chain_fuids", "vector[string]"},
+		{"subject", "string"},
+		{"issuer", "string"},
+		{"client_subject", "string"},
+		{"client_issuer", "string"},
+	}
+
+	zeekX509Fields = []zeekField{
+		{"ts", "time"},
+		{"id", "string"},
+		{"certificate.version", "count"},
+		{"certificate.serial", "string"},
+		{"certificate.subject", "string"},
+		{"certificate.issuer", "string"},
+		{"certificate.not_valid_before", "time"},
+		{"certificate.not_valid_after", "time"},
+		{"certificate.key_alg", "string"},
+		{"certificate.sig_alg", "string"},
+		{"certificate.key_type", "string"},
+		{"certificate.key_length", "count"},
+		{"certificate.exponent", "string"},
+		{"certificate.curve", "string"},
+		{"san.dns", "vector[string]"},
+		{"san.uri", "vector[string]"},
+		{"san.email", "vector[string]"},
+		{"san.ip", "vector[addr]"},
+		{"basic_constraints.ca", "bool"},
+		{"basic_constraints.path_len", "count"},
+	}
+)
+
+// zeekVersions maps TLS versions to the names used in Zeek's ssl.log.
+var zeekVersions = map[uint16]string{
+	0x0300: "SSLv3",
+	0x0301: "TLSv10",
+	0x0302: "TLSv11",
+	0x0303: "TLSv12",
+	0x0304: "TLSv13",
+}
+
+// OpenSSL names of public key and signature algorithms, as found in x509.log.
+var (
+	opensslKeyAlgorithms = map[x509.PublicKeyAlgorithm]string{
+		x509.RSA:     "rsaEncryption",
+		x509.DSA:     "dsaEncryption",
+		x509.ECDSA:   "id-ecPublicKey",
+		x509.Ed25519: "ED25519",
+	}
+
+	opensslSignatureAlgorithms = map[x509.SignatureAlgorithm]string{
+		x509.MD2WithRSA:       "md2WithRSAEncryption",
+		x509.MD5WithRSA:       "md5WithRSAEncryption",
+		x509.SHA1WithRSA:      "sha1WithRSAEncryption",
+		x509.SHA256WithRSA:    "sha256WithRSAEncryption",
+		x509.SHA384WithRSA:    "sha384WithRSAEncryption",
+		x509.SHA512WithRSA:    "sha512WithRSAEncryption",
+		x509.DSAWithSHA1:      "dsaWithSHA1",
+		x509.DSAWithSHA256:    "dsa_with_SHA256",
+		x509.ECDSAWithSHA1:    "ecdsa-with-SHA1",
+		x509.ECDSAWithSHA256:  "ecdsa-with-SHA256",
+		x509.ECDSAWithSHA384:  "ecdsa-with-SHA384",
+		x509.ECDSAWithSHA512:  "ecdsa-with-SHA512",
+		x509.SHA256WithRSAPSS: "rsassaPss",
+		x509.SHA384WithRSAPSS: "rsassaPss",
+		x509.SHA512WithRSAPSS: "rsassaPss",
+		x509.PureEd25519:      "ED25519",
+	}
+
+	opensslCurves = map[string]string{
+		"P-224": "secp224r1",
+		"P-256": "prime256v1",
+		"P-384": "secp384r1",
+		"P-521": "secp521r1",
+	}
+)
+
+// zeekLog writes a single Zeek log, either in Zeek's tab separated format
+// with its header and footer, or as one JSON object per line.
+type zeekLog struct {
+	path   string
+	fields []zeekField
+	json   bool
+	// sync on flush
+	durable bool
+	// the wall clock, for #open and #close
+	now func() time.Time
+	f   *os.File
+	w   *bufio.Writer
+}
+
+func newZeekLog(fs fileSystem, dir, path string, fields []zeekField, json, durable bool, now func() time.Time) (*zeekLog, error) {
+	name := path + ".log"
+	if json {
+		name = path + ".json"
+	}
+	f, err := createFile(fs, filepath.Join(dir, name))
+	if err != nil {
+		return nil, err
+	}
+	l := &zeekLog{
+		path:    path,
+		fields:  fields,
+		json:    json,
+		durable: durable,
+		now:     now,
+		f:       f,
+		w:       bufio.NewWriter(f),
+	}
+	if !json {
+		l.header()
+	}
+	return l, nil
+}
+
+func (l *zeekLog) header() {
+	names := make([]string, len(l.fields))
+	types := make([]string, len(l.fields))
+	for i, field := range l.fields {
+		names[i] = field.name
+		types[i] = field.typ
+	}
+	fmt.Fprintf(l.w, "#separator \\x09\n")
+	fmt.Fprintf(l.w, "#set_separator\t%s\n", zeekSetSeparator)
+	fmt.Fprintf(l.w, "#empty_field\t%s\n", zeekEmptyField)
+	fmt.Fprintf(l.w, "#unset_field\t%s\n", zeekUnsetField)
+	fmt.Fprintf(l.w, "#path\t%s\n", l.path)
+	fmt.Fprintf(l.w, "#open\t%s\n", l.now().UTC().Format(zeekTimeFormat))
+	fmt.Fprintf(l.w, "#fields\t%s\n", strings.Join(names, "\t"))
+	fmt.Fprintf(l.w, "#types\t%s\n", strings.Join(types, "\t"))
+}
+
+// write writes a record, values are in the order of the log's fields. A nil
+// value is unset.
+func (l *zeekLog) write(values ...interface{}) (err error) {
+	if l.json {
+		return l.writeJSON(values)
+	}
+	for i, v := range values {
+		if i > 0 {
+			l.w.WriteByte('\t')
+		}
+		l.w.WriteString(zeekTSVValue(v))
+	}
+	_, err = l.w.WriteString("\n")
+	return
+}
+
+// writeJSON writes a record the way Zeek's JSON writer does: unset fields are
+// left out and timestamps are seconds since the epoch.
+func (l *zeekLog) writeJSON(values []interface{}) error {
+	l.w.WriteByte('{')
+	first := true
+	for i, v := range values {
+		if v == nil {
+			continue
+		}
+		if !first {
+			l.w.WriteByte(',')
+		}
+		first = false
+
+		key, _ := json.Marshal(l.fields[i].name)
+		l.w.Write(key)
+		l.w.WriteByte(':')
+
+		if t, ok := v.(time.Time); ok {
+			l.w.WriteString(zeekTime(t))
+			continue
+		}
+		raw, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		l.w.Write(raw)
+	}
+	_, err := l.w.WriteString("}\n")
+	return err
+}
+
+func (l *zeekLog) flush() error {
+	if err := l.w.Flush(); err != nil || !l.durable {
+		return err
+	}
+	return l.f.Sync()
+}
+
+func (l *zeekLog) close() error {
+	if !l.json {
+		fmt.Fprintf(l.w, "#close\t%s\n", l.now().UTC().Format(zeekTimeFormat))
+	}
+	err := l.flush()
+	if cerr := l.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func zeekTSVValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return zeekUnsetField
+	case time.Time:
+		return zeekTime(v)
+	case string:
+		return zeekEscape(v, false)
+	case int:
+		return strconv.Itoa(v)
+	case bool:
+		if v {
+			return "T"
+		}
+		return "F"
+	case []string:
+		if len(v) == 0 {
+			return zeekEmptyField
+		}
+		escaped := make([]string, len(v))
+		for i, s := range v {
+			escaped[i] = zeekEscape(s, true)
+		}
+		return strings.Join(escaped, zeekSetSeparator)
+	}
+	panic(fmt.Sprintf("unsupported zeek value %T", v))
+}
+
+func zeekTime(t time.Time) string {
+	return fmt.Sprintf("%d.%06d", t.Unix(), t.Nanosecond()/1000)
+}
+
+// zeekEscape escapes a string like Zeek's ASCII writer: non printable bytes
+// and separators are hex escaped, values that would be mistaken for the empty
+// or unset markers are escaped as a whole.
+func zeekEscape(s string, inSet bool) string {
+	if s == "" {
+		return zeekEmptyField
+	}
+	if s == zeekUnsetField || s == zeekEmptyField {
+		return hexEscape(s)
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < 0x20 || c >= 0x7f || c == '\\' || (inSet && c == zeekSetSeparator[0]) {
+			fmt.Fprintf(&b, "\\x%02x", c)
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+func hexEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		fmt.Fprintf(&b, "\\x%02x", s[i])
+	}
+	return b.String()
+}
+
+// zeekUID derives a Zeek style identifier (a prefix followed by a base62
+// number) from a digest. Unlike Zeek's random ids they are stable, the same
+// capture always yields the same ids.
+func zeekUID(prefix string, digest []byte) string {
+	n := new(big.Int).SetBytes(digest[:12])
+	return prefix + n.Text(62)
+}
+
+// connectionUID is the uid of the connection an observation was made on.
+func connectionUID(obs Observation) string {
+	return zeekUID("C", obs.connectionID())
+}
+
+// zeekWriter writes an ssl.log record per chain and an x509.log record per
+// certificate, linked through the file ids in cert_chain_fuids.
+type zeekWriter struct {
+	ssl  *zeekLog
+	x509 *zeekLog
+}
+
+func newZeekWriter(fs fileSystem, dir string, json, durable bool, now func() time.Time) (*zeekWriter, error) {
+	ssl, err := newZeekLog(fs, dir, "ssl", zeekSSLFields, json, durable, now)
+	if err != nil {
+		return nil, err
+	}
+	certs, err := newZeekLog(fs, dir, "x509", zeekX509Fields, json, durable, now)
+	if err != nil {
+		ssl.close()
+		return nil, err
+	}
+	return &zeekWriter{ssl: ssl, x509: certs}, nil
+}
+
+func (w *zeekWriter) Observe(_ context.Context, obs Observation) error {
+	uid := connectionUID(obs)
+
+	fuids := make([]string, len(obs.Chain))
+	for i, cert := range obs.Chain {
+		fuids[i] = zeekUID("F", digestParts(uid, strconv.Itoa(i)))
+		if err := w.writeCertificate(obs.seen(), fuids[i], cert); err != nil {
+			return err
+		}
+	}
+
+	ts := obs.ConnectionStart
+	if ts.IsZero() {
+		ts = obs.seen()
+	}
+	clientIP, clientPort := splitHostPort(obs.Client)
+	serverIP, serverPort := splitHostPort(obs.Server)
+
+	var subject, issuer interface{}
+	if len(obs.Chain) > 0 {
+		subject = obs.Chain[0].Subject.String()
+		issuer = obs.Chain[0].Issuer.String()
+	}
+
+	return w.ssl.write(
+		ts.UTC(),
+		uid,
+		clientIP, clientPort,
+		serverIP, serverPort,
+		optionalString(zeekVersions[obs.Version]),
+		optionalString(cipherSuiteName(obs.CipherSuite)),
+		nil, // curve
+		optionalString(obs.ServerName),
+		false, // resumed, a chain means a full handshake
+		nil,   // last_alert
+		nil,   // next_protocol
+		nil,   // established, only the server's flight is seen
+		fuids,
+		[]string{},
+		subject, issuer,
+		nil, nil,
+	)
+}
+
+func (w *zeekWriter) writeCertificate(ts time.Time, fuid string, cert *x509.Certificate) error {
+	var (
+		keyType, exponent, curve interface{}
+		keyLength                interface{}
+	)
+	switch key := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		keyType = "rsa"
+		keyLength = key.N.BitLen()
+		exponent = strconv.Itoa(key.E)
+	case *ecdsa.PublicKey:
+		keyType = "ecdsa"
+		keyLength = key.Params().BitSize
+		curve = optionalString(opensslCurves[key.Params().Name])
+	case *dsa.PublicKey:
+		keyType = "dsa"
+		keyLength = key.P.BitLen()
+	}
+
+	var ips, uris []string
+	for _, ip := range cert.IPAddresses {
+		ips = append(ips, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		uris = append(uris, uri.String())
+	}
+
+	var ca, pathLen interface{}
+	if cert.BasicConstraintsValid {
+		ca = cert.IsCA
+		if cert.MaxPathLen > 0 || cert.MaxPathLenZero {
+			pathLen = cert.MaxPathLen
+		}
+	}
+
+	return w.x509.write(
+		ts.UTC(),
+		fuid,
+		cert.Version,
+		strings.ToUpper(cert.SerialNumber.Text(16)),
+		cert.Subject.String(),
+		cert.Issuer.String(),
+		cert.NotBefore.UTC(),
+		cert.NotAfter.UTC(),
+		optionalString(opensslKeyAlgorithms[cert.PublicKeyAlgorithm]),
+		optionalString(opensslSignatureAlgorithms[cert.SignatureAlgorithm]),
+		keyType, keyLength, exponent, curve,
+		optionalList(cert.DNSNames),
+		optionalList(uris),
+		optionalList(cert.EmailAddresses),
+		optionalList(ips),
+		ca, pathLen,
+	)
+}
+
+func (w *zeekWriter) flush() error {
+	if err := w.ssl.flush(); err != nil {
+		return err
+	}
+	return w.x509.flush()
+}
+
+func (w *zeekWriter) Close() error {
+	err := w.ssl.close()
+	if xerr := w.x509.close(); err == nil {
+		err = xerr
+	}
+	return err
+}
+
+// optionalString returns nil, an unset field, for empty strings.
+func optionalString(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// optionalList returns nil, an unset field, for empty lists.
+func optionalList(list []string) interface{} {
+	if len(list) == 0 {
+		return nil
+	}
+	return list
+}